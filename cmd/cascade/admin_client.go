@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cascade/internal/admin"
+	"cascade/internal/cache"
+)
+
+// entryBackend is where the cache subcommands read and purge entries: either
+// a cache directory opened offline or a running instance's admin API.
+type entryBackend interface {
+	List(filter cache.EntryFilter, limit int) ([]*cache.CacheEntry, error)
+	Lookup(target string) (*cache.CacheEntry, error)
+	PurgeURL(target string) (admin.PurgeResult, error)
+	Purge(filter cache.EntryFilter) (admin.PurgeResult, error)
+}
+
+type offlineBackend struct {
+	storage *cache.Storage
+}
+
+func (b *offlineBackend) List(filter cache.EntryFilter, limit int) ([]*cache.CacheEntry, error) {
+	return b.storage.List(filter, limit)
+}
+
+func (b *offlineBackend) Lookup(target string) (*cache.CacheEntry, error) {
+	entry, err := b.storage.Lookup(target)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("not cached: %s", target)
+	}
+	return entry, err
+}
+
+func (b *offlineBackend) PurgeURL(target string) (admin.PurgeResult, error) {
+	entry, err := b.storage.Lookup(target)
+	if os.IsNotExist(err) {
+		return admin.PurgeResult{}, nil
+	}
+	if err != nil {
+		return admin.PurgeResult{}, err
+	}
+	if err := b.storage.Delete(target); err != nil {
+		return admin.PurgeResult{}, err
+	}
+	return admin.PurgeResult{Purged: 1, Bytes: entry.Size}, nil
+}
+
+func (b *offlineBackend) Purge(filter cache.EntryFilter) (admin.PurgeResult, error) {
+	count, bytes, err := b.storage.Purge(filter)
+	return admin.PurgeResult{Purged: count, Bytes: bytes}, err
+}
+
+// adminClient talks to the admin API of a running instance.
+type adminClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newAdminClient(base, token string) *adminClient {
+	return &adminClient{
+		base:   strings.TrimSuffix(base, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (c *adminClient) do(method, path string, q url.Values, out interface{}) error {
+	u := c.base + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("admin API: %s", apiErr.Error)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *adminClient) List(filter cache.EntryFilter, limit int) ([]*cache.CacheEntry, error) {
+	q := admin.FilterQuery(filter)
+	if limit > 0 {
+		q.Set("limit", fmt.Sprint(limit))
+	}
+	var entries []*cache.CacheEntry
+	err := c.do(http.MethodGet, "/api/entries", q, &entries)
+	return entries, err
+}
+
+func (c *adminClient) Lookup(target string) (*cache.CacheEntry, error) {
+	var entry cache.CacheEntry
+	if err := c.do(http.MethodGet, "/api/entry", url.Values{"url": {target}}, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (c *adminClient) PurgeURL(target string) (admin.PurgeResult, error) {
+	var result admin.PurgeResult
+	err := c.do(http.MethodPost, "/api/purge", url.Values{"url": {target}}, &result)
+	return result, err
+}
+
+func (c *adminClient) Purge(filter cache.EntryFilter) (admin.PurgeResult, error) {
+	var result admin.PurgeResult
+	err := c.do(http.MethodPost, "/api/purge", admin.FilterQuery(filter), &result)
+	return result, err
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"cascade/internal/admin"
+	"cascade/internal/cache"
+	"cascade/internal/config"
+)
+
+func runCache(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: cascade cache <verify|ls|show|purge> [flags]")
+		return 2
+	}
+
+	switch args[0] {
+	case "verify", "fsck":
+		return runCacheVerify(args[1:])
+	case "ls", "list":
+		return runCacheList(args[1:])
+	case "show":
+		return runCacheShow(args[1:])
+	case "purge":
+		return runCachePurge(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown cache command: %s\n", args[0])
+		return 2
+	}
+}
+
+func runCacheVerify(args []string) int {
+	fs := flag.NewFlagSet("cache verify", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	dir := fs.String("dir", "", "Cache directory (overrides the configuration file)")
+	repair := fs.Bool("repair", false, "Remove, quarantine or evict broken objects")
+	checksums := fs.Bool("checksums", true, "Re-hash data files with a recorded checksum")
+	jsonOut := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	storage, err := openCacheDir(fs, *cfgPath, *dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 2
+	}
+
+	report, err := storage.Verify(cache.VerifyOptions{
+		Checksums: *checksums,
+		Repair:    *repair,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: verify failed: %v\n", err)
+		return 2
+	}
+
+	if *jsonOut {
+		printJSON(report)
+	} else {
+		for _, p := range report.Notices {
+			printProblem("INFO", p)
+		}
+		for _, p := range report.Problems {
+			status := "FOUND"
+			if p.Repaired {
+				status = "FIXED"
+			}
+			printProblem(status, p)
+		}
+		fmt.Printf("%d entries, %d valid, %d expired, %d busy, %d bytes of %d, %d problems (%d unrepaired)\n",
+			report.Entries, report.Valid, len(report.Notices), report.Busy, report.TotalBytes, report.MaxBytes,
+			len(report.Problems), report.Unrepaired())
+	}
+
+	if report.Unrepaired() > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printProblem(status string, p cache.Problem) {
+	line := fmt.Sprintf("%-5s %-17s %s", status, p.Kind, p.Path)
+	if p.URL != "" {
+		line += " (" + p.URL + ")"
+	}
+	if p.Detail != "" {
+		line += ": " + p.Detail
+	}
+	fmt.Println(line)
+}
+
+// openCacheDir opens the cache directory named by dir, or by the
+// configuration, environment included, when dir is empty, for offline
+// maintenance.
+func openCacheDir(fs *flag.FlagSet, cfgPath, dir string) (*cache.Storage, error) {
+	var maxSizeBytes int64
+
+	cfg, err := loadConfig(configFile(fs, cfgPath), nil)
+	switch {
+	case err == nil:
+		maxSizeBytes = int64(cfg.Cache.MaxSizeGB * 1024 * 1024 * 1024)
+		if dir == "" {
+			dir = cfg.Cache.Directory
+		}
+	case dir == "":
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	return cache.OpenStorage(dir, maxSizeBytes)
+}
+
+// backendFlags registers the flags that select where entries are read from
+// and returns a function that opens the selected backend.
+func backendFlags(fs *flag.FlagSet) func() (entryBackend, error) {
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	dir := fs.String("dir", "", "Cache directory (overrides the configuration file)")
+	adminURL := fs.String("admin", "", "Admin API base URL of a running instance, e.g. http://127.0.0.1:3143")
+	token := fs.String("token", os.Getenv("CASCADE_ADMIN_TOKEN"), "Admin API bearer token (default $CASCADE_ADMIN_TOKEN)")
+
+	return func() (entryBackend, error) {
+		if *adminURL != "" {
+			return newAdminClient(*adminURL, *token), nil
+		}
+		storage, err := openCacheDir(fs, *cfgPath, *dir)
+		if err != nil {
+			return nil, err
+		}
+		return &offlineBackend{storage: storage}, nil
+	}
+}
+
+// filterFlags registers the entry selection flags shared by ls and purge.
+func filterFlags(fs *flag.FlagSet) func() (cache.EntryFilter, error) {
+	pattern := fs.String("url", "", "URL glob, e.g. '*.deb'")
+	host := fs.String("host", "", "Host glob, e.g. '*.debian.org'")
+	minSize := fs.String("min-size", "", "Minimum size, e.g. 10M")
+	maxSize := fs.String("max-size", "", "Maximum size, e.g. 1G")
+	olderThan := fs.Duration("older-than", 0, "Only entries created at least this long ago")
+	newerThan := fs.Duration("newer-than", 0, "Only entries created at most this long ago")
+
+	return func() (cache.EntryFilter, error) {
+		filter := cache.EntryFilter{
+			URL:       *pattern,
+			Host:      *host,
+			OlderThan: *olderThan,
+			NewerThan: *newerThan,
+		}
+
+		var err error
+		if filter.MinSize, err = config.ParseSize(*minSize); err != nil {
+			return filter, fmt.Errorf("invalid -min-size: %w", err)
+		}
+		if filter.MaxSize, err = config.ParseSize(*maxSize); err != nil {
+			return filter, fmt.Errorf("invalid -max-size: %w", err)
+		}
+		return filter, nil
+	}
+}
+
+func runCacheList(args []string) int {
+	fs := flag.NewFlagSet("cache ls", flag.ContinueOnError)
+	openBackend := backendFlags(fs)
+	getFilter := filterFlags(fs)
+	limit := fs.Int("limit", 0, "Maximum number of entries to list")
+	jsonOut := fs.Bool("json", false, "Print entries as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	filter, err := getFilter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 2
+	}
+
+	backend, err := openBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 2
+	}
+
+	entries, err := backend.List(filter, *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(entries)
+		return 0
+	}
+
+	var total int64
+	for _, e := range entries {
+		expires := "expired"
+		if !e.IsExpired() {
+			expires = time.Until(e.ExpiresAt).Round(time.Second).String()
+		}
+		fmt.Printf("%10s  %12s  %12s  %s\n", formatSize(e.Size),
+			time.Since(e.CreatedAt).Round(time.Second), expires, e.URL)
+		total += e.Size
+	}
+	fmt.Printf("%d entries, %s\n", len(entries), formatSize(total))
+	return 0
+}
+
+func runCacheShow(args []string) int {
+	fs := flag.NewFlagSet("cache show", flag.ContinueOnError)
+	openBackend := backendFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cascade cache show [flags] <url>")
+		return 2
+	}
+
+	backend, err := openBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 2
+	}
+
+	entry, err := backend.Lookup(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 1
+	}
+
+	printJSON(entry)
+	return 0
+}
+
+func runCachePurge(args []string) int {
+	fs := flag.NewFlagSet("cache purge", flag.ContinueOnError)
+	openBackend := backendFlags(fs)
+	getFilter := filterFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "List what would be purged without deleting it")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	filter, err := getFilter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 2
+	}
+	if fs.NArg() == 0 && filter.IsZero() {
+		fmt.Fprintln(os.Stderr, "usage: cascade cache purge [flags] <url>... | -url <glob> | -host <glob>")
+		return 2
+	}
+
+	backend, err := openBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 2
+	}
+
+	if *dryRun {
+		var entries []*cache.CacheEntry
+		for _, target := range fs.Args() {
+			if entry, err := backend.Lookup(target); err == nil {
+				entries = append(entries, entry)
+			}
+		}
+		if !filter.IsZero() {
+			matched, err := backend.List(filter, 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+				return 1
+			}
+			entries = append(entries, matched...)
+		}
+		var total int64
+		for _, e := range entries {
+			fmt.Printf("would purge %s (%s)\n", e.URL, formatSize(e.Size))
+			total += e.Size
+		}
+		fmt.Printf("%d entries, %s\n", len(entries), formatSize(total))
+		return 0
+	}
+
+	var total admin.PurgeResult
+	for _, target := range fs.Args() {
+		result, err := backend.PurgeURL(target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+			return 1
+		}
+		total.Purged += result.Purged
+		total.Bytes += result.Bytes
+	}
+	if !filter.IsZero() {
+		result, err := backend.Purge(filter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+			return 1
+		}
+		total.Purged += result.Purged
+		total.Bytes += result.Bytes
+	}
+
+	fmt.Printf("purged %d entries, %s\n", total.Purged, formatSize(total.Bytes))
+	return 0
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"cascade/internal/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+func runConfig(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: cascade config <check|dump|schema> [flags]")
+		return 2
+	}
+
+	switch args[0] {
+	case "check":
+		return runConfigCheck(args[1:])
+	case "dump":
+		return runConfigDump(args[1:])
+	case "schema":
+		printJSON(config.Schema())
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown config command: %s\n", args[0])
+		return 2
+	}
+}
+
+// CheckReport is the -json output of cascade config check.
+type CheckReport struct {
+	File     string           `json:"file"`
+	Valid    bool             `json:"valid"`
+	Errors   []config.Problem `json:"errors"`
+	Warnings []config.Problem `json:"warnings"`
+}
+
+// runConfigCheck loads a configuration file the way the server does and
+// reports every problem found. It exits 1 if the file is invalid.
+func runConfigCheck(args []string) int {
+	fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	jsonOut := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	path := configFile(fs, *cfgPath)
+	report := CheckReport{File: path, Errors: []config.Problem{}, Warnings: []config.Problem{}}
+	if path == "" {
+		report.File = "(no file)"
+	}
+	cfg, err := loadConfig(path, nil)
+	var verr *config.ValidationError
+	switch {
+	case err == nil:
+		report.Valid = true
+		report.Warnings = append(report.Warnings, cfg.Warnings()...)
+	case errors.As(err, &verr):
+		report.Errors = verr.Problems
+	default:
+		report.Errors = append(report.Errors, config.Problem{Message: err.Error()})
+	}
+
+	if *jsonOut {
+		printJSON(report)
+	} else {
+		for _, p := range report.Errors {
+			fmt.Printf("%s: error: %s\n", report.File, p)
+		}
+		for _, p := range report.Warnings {
+			fmt.Printf("%s: warning: %s\n", report.File, p)
+		}
+		if report.Valid {
+			fmt.Printf("%s: OK\n", report.File)
+		}
+	}
+
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+// runConfigDump prints the effective configuration: the file merged with its
+// includes and drop-ins, environment overrides and defaults, with secrets
+// redacted.
+func runConfigDump(args []string) int {
+	fs := flag.NewFlagSet("config dump", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(configFile(fs, *cfgPath), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: failed to load configuration: %v\n", err)
+		return 1
+	}
+	for _, w := range cfg.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+
+	for _, file := range cfg.Files() {
+		fmt.Printf("# from %s\n", file)
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 1
+	}
+	return 0
+}
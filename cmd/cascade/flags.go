@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"cascade/internal/config"
+)
+
+// overrideFlag sets one configuration setting from the command line.
+type overrideFlag struct {
+	setting   config.Setting
+	overrides *[]config.Override
+}
+
+func (f *overrideFlag) String() string { return "" }
+
+func (f *overrideFlag) Set(value string) error {
+	*f.overrides = append(*f.overrides, config.Override{Source: "-" + f.setting.Path, Path: f.setting.Path, Value: value})
+	return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool { return f.setting.Type == "bool" }
+
+// overrideFlags registers a flag named after every configuration setting,
+// e.g. -server.port, and returns the overrides given on the command line in
+// order.
+func overrideFlags(flags *flag.FlagSet) *[]config.Override {
+	overrides := new([]config.Override)
+	for _, s := range config.Settings() {
+		usage := fmt.Sprintf("Set %s as `%s` (or $%s)", s.Path, s.Type, s.Env)
+		if s.Type == "bool" {
+			usage = fmt.Sprintf("Set %s (or $%s)", s.Path, s.Env)
+		}
+		flags.Var(&overrideFlag{setting: s, overrides: overrides}, s.Path, usage)
+	}
+	return overrides
+}
+
+// configFile returns the configuration file to load: -config if given, else
+// $CASCADE_CONFIG, else the default if it exists. An empty result means
+// running on defaults, environment variables and flags alone.
+func configFile(flags *flag.FlagSet, path string) string {
+	explicit := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	if explicit {
+		return path
+	}
+	if env, ok := os.LookupEnv(config.EnvPrefix + "CONFIG"); ok {
+		return env
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return ""
+	}
+	return path
+}
+
+// loadConfig loads the configuration the way the server does: the file, then
+// CASCADE_ environment variables, then flags, each overriding the one before.
+func loadConfig(path string, flags []config.Override) (*config.Config, error) {
+	overrides, err := config.EnvOverrides(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	return config.Load(path, append(overrides, flags...)...)
+}
@@ -4,35 +4,87 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"cascade/internal/accesslog"
+	"cascade/internal/admin"
 	"cascade/internal/cache"
 	"cascade/internal/config"
+	"cascade/internal/logging"
+	"cascade/internal/metrics"
 	"cascade/internal/proxy"
+	"cascade/internal/tracing"
 )
 
 var (
-	configPath = flag.String("config", "config.yaml", "Path to configuration file")
+	configPath = flag.String("config", "config.yaml", "Path to configuration file (default $CASCADE_CONFIG, or config.yaml if it exists)")
+	overrides  = overrideFlags(flag.CommandLine)
 	version    = "dev"
 )
 
+var logger = logging.For("main")
+
+// subcommands are offline maintenance tools selected by the first argument.
+var subcommands = map[string]func(args []string) int{
+	"cache":  runCache,
+	"rules":  runRules,
+	"config": runConfig,
+}
+
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
 
-	log.Printf("Starting Cascade v%s - HTTP/HTTPS Caching Proxy", version)
+	flag.Parse()
 
-	cfg, err := config.Load(*configPath)
+	path := configFile(flag.CommandLine, *configPath)
+	load := func() (*config.Config, error) {
+		return loadConfig(path, *overrides)
+	}
+	cfg, err := load()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatal("failed to load configuration", err)
+	}
+
+	if err := setupLogging(cfg.Log); err != nil {
+		fatal("failed to configure logging", err)
 	}
 
-	log.Printf("Cascade started - Cache: %s (%.3f GB), Buffer: %d KB, TTL: %v",
-		cfg.Cache.Directory, cfg.Cache.MaxSizeGB, cfg.Cache.BufferSizeKB, cfg.Cache.DefaultTTL)
+	if path == "" {
+		logger.Info("no configuration file, using defaults, environment and flags")
+	}
+	for _, w := range cfg.Warnings() {
+		logger.Warn("configuration warning", "problem", w.String())
+	}
+
+	logger.Info("starting Cascade", "version", version,
+		"config_files", cfg.Files(),
+		"cache_dir", cfg.Cache.Directory,
+		"cache_size_gb", cfg.Cache.MaxSizeGB,
+		"buffer_kb", cfg.Cache.BufferSizeKB,
+		"default_ttl", cfg.Cache.DefaultTTL.String())
+
+	if cfg.Tracing.Enabled {
+		shutdown, err := tracing.Setup(cfg.Tracing.Endpoint, cfg.Tracing.Headers, cfg.Tracing.ServiceName, cfg.Tracing.SampleRatio)
+		if err != nil {
+			fatal("failed to configure tracing", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				logger.Error("failed to flush traces", "err", err)
+			}
+		}()
+		logger.Info("exporting traces", "endpoint", cfg.Tracing.Endpoint)
+	}
 
 	maxSizeBytes := int64(cfg.Cache.MaxSizeGB * 1024 * 1024 * 1024)
 	storage, err := cache.NewStorage(
@@ -41,39 +93,113 @@ func main() {
 		cfg.Cache.BufferSizeKB,
 		cfg.Cache.MinFileSizeKB,
 		cfg.Cache.MaxFileSizeMB,
+		cfg.Cache.StaleIfError,
 	)
 	if err != nil {
-		log.Fatalf("Failed to initialize cache storage: %v", err)
+		fatal("failed to initialize cache storage", err)
 	}
+	defer storage.Close()
+	if err := storage.SetChecksum(cfg.Cache.Checksum); err != nil {
+		fatal("failed to configure cache checksums", err)
+	}
+	storage.SetVerifyOnRead(cfg.Cache.VerifyOnRead)
 
 	proxyHandler, err := proxy.New(cfg, storage)
 	if err != nil {
-		log.Fatalf("Failed to create proxy: %v", err)
+		fatal("failed to create proxy", err)
+	}
+
+	if cfg.AccessLog.Path != "" {
+		accessLog, err := accesslog.Open(cfg.AccessLog.Path, cfg.AccessLog.Format)
+		if err != nil {
+			fatal("failed to open access log", err)
+		}
+		defer accessLog.Close()
+		proxyHandler.SetAccessLog(accessLog)
+
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, syscall.SIGUSR1)
+		go func() {
+			for range reopen {
+				if err := accessLog.Reopen(); err != nil {
+					logger.Error("failed to reopen access log", "err", err)
+				}
+			}
+		}()
 	}
 
+	storage.RegisterMetrics(metrics.Default)
+	storage.SetCorruptionHandler(func(entry *cache.CacheEntry) {
+		proxyHandler.Prefetch(entry.URL)
+	})
+	storage.StartScavenger(cfg.Cache.ScavengeInterval)
+	storage.StartScrubber(cfg.Cache.ScrubInterval)
+
 	server := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
 		Handler: proxyHandler,
 	}
 
 	go func() {
-		log.Printf("Cascade proxy listening on %s", server.Addr)
+		logger.Info("proxy listening", "addr", server.Addr)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+			fatal("proxy server failed", err)
 		}
 	}()
 
+	reload := &reloader{load: load, cfg: cfg, proxy: proxyHandler, storage: storage}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload.reload()
+		}
+	}()
+
+	var adminServer *http.Server
+	if cfg.Admin.Enabled {
+		if cfg.Admin.Token == "" && cfg.Admin.Username == "" {
+			logger.Warn("admin API has no authentication configured", "addr", fmt.Sprintf("%s:%d", cfg.Admin.Host, cfg.Admin.Port))
+		}
+
+		adminHandler := admin.New(storage, proxyHandler)
+		adminHandler.SetReloader(reload.reload)
+		adminServer = &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", cfg.Admin.Host, cfg.Admin.Port),
+			Handler: adminHandler,
+		}
+
+		go func() {
+			logger.Info("admin API listening", "addr", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("admin server failed", err)
+			}
+		}()
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
 
-	log.Printf("Shutting down gracefully...")
+	logger.Info("shutting down gracefully")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Error during server shutdown: %v", err)
+		logger.Error("proxy server shutdown failed", "err", err)
 		server.Close()
 	}
-	log.Printf("Cascade stopped")
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logger.Error("admin server shutdown failed", "err", err)
+			adminServer.Close()
+		}
+	}
+	logger.Info("Cascade stopped")
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
 }
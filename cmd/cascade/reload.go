@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"cascade/internal/admin"
+	"cascade/internal/cache"
+	"cascade/internal/config"
+	"cascade/internal/logging"
+	"cascade/internal/proxy"
+)
+
+// reloader re-reads the configuration and applies it to the running server.
+// A configuration that fails to load or apply leaves the running one in
+// place.
+type reloader struct {
+	mu      sync.Mutex
+	load    func() (*config.Config, error)
+	cfg     *config.Config
+	proxy   *proxy.Proxy
+	storage *cache.Storage
+}
+
+func (r *reloader) reload() (admin.ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	logger.Info("reloading configuration")
+	cfg, err := r.load()
+	if err != nil {
+		logger.Error("configuration reload failed, keeping the running configuration", "err", err)
+		return admin.ReloadResult{}, err
+	}
+	restart, err := cfg.CarryOver(r.cfg)
+	if err != nil {
+		err = fmt.Errorf("with the settings that need a restart kept as they are: %w", err)
+		logger.Error("configuration reload failed, keeping the running configuration", "err", err)
+		return admin.ReloadResult{}, err
+	}
+
+	// Everything that can fail is checked before anything is applied, so a
+	// failed reload leaves the whole server on the running configuration.
+	if err := checkLogging(cfg.Log); err != nil {
+		logger.Error("configuration reload failed, keeping the running configuration", "err", err)
+		return admin.ReloadResult{}, err
+	}
+	applyProxy, err := r.proxy.PrepareReload(cfg)
+	if err != nil {
+		logger.Error("configuration reload failed, keeping the running configuration", "err", err)
+		return admin.ReloadResult{}, err
+	}
+
+	applyProxy()
+	// Load has validated the algorithm and checkLogging the log settings.
+	r.storage.SetChecksum(cfg.Cache.Checksum)
+	r.storage.SetVerifyOnRead(cfg.Cache.VerifyOnRead)
+	r.storage.SetStaleIfError(cfg.Cache.StaleIfError)
+	r.storage.SetLimits(int64(cfg.Cache.MaxSizeGB*1024*1024*1024), cfg.Cache.MinFileSizeKB, cfg.Cache.MaxFileSizeMB)
+	setupLogging(cfg.Log)
+	r.cfg = cfg
+
+	result := admin.ReloadResult{RestartRequired: restart, Warnings: []string{}}
+	if result.RestartRequired == nil {
+		result.RestartRequired = []string{}
+	}
+	for _, path := range restart {
+		logger.Warn("setting changed but only takes effect after a restart", "setting", path)
+	}
+	for _, w := range cfg.Warnings() {
+		logger.Warn("configuration warning", "problem", w.String())
+		result.Warnings = append(result.Warnings, w.String())
+	}
+	logger.Info("configuration reloaded")
+	return result, nil
+}
+
+// checkLogging reports whether setupLogging would fail for cfg.
+func checkLogging(cfg config.LogConfig) error {
+	if _, err := logging.ParseLevel(cfg.Level); err != nil {
+		return err
+	}
+	if !logging.ValidFormat(cfg.Format) {
+		return fmt.Errorf("unsupported log format: %s", cfg.Format)
+	}
+	return nil
+}
+
+// setupLogging applies the log settings, turning debug logging on for the
+// listed subsystems and off for all others.
+func setupLogging(cfg config.LogConfig) error {
+	if err := logging.Setup(os.Stderr, cfg.Level, cfg.Format); err != nil {
+		return err
+	}
+	debug := make(map[string]bool)
+	for _, name := range cfg.Debug {
+		debug[name] = true
+	}
+	for name := range logging.Subsystems() {
+		if err := logging.SetDebug(name, debug[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"cascade/internal/proxy"
+)
+
+func runRules(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: cascade rules test [flags] [url ...]")
+		return 2
+	}
+
+	switch args[0] {
+	case "test":
+		return runRulesTest(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown rules command: %s\n", args[0])
+		return 2
+	}
+}
+
+// runRulesTest prints what the rules decide for each URL given as an
+// argument or, without arguments, one per line on stdin.
+func runRulesTest(args []string) int {
+	fs := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	jsonOut := fs.Bool("json", false, "Print the decisions as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(configFile(fs, *cfgPath), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: failed to load configuration: %v\n", err)
+		return 2
+	}
+	evaluator, err := proxy.NewEvaluator(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+		return 2
+	}
+
+	urls := fs.Args()
+	if len(urls) == 0 {
+		urls, err = readURLs(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cascade: failed to read URLs: %v\n", err)
+			return 2
+		}
+	}
+
+	decisions := make([]proxy.Decision, 0, len(urls))
+	for _, raw := range urls {
+		target, err := normalizeURL(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cascade: %v\n", err)
+			return 2
+		}
+		decisions = append(decisions, evaluator.Evaluate(target))
+	}
+
+	if *jsonOut {
+		printJSON(decisions)
+		return 0
+	}
+
+	for i, d := range decisions {
+		if i > 0 {
+			fmt.Println()
+		}
+		printDecision(d)
+	}
+	return 0
+}
+
+// readURLs reads one URL per line, skipping blank lines and # comments.
+func readURLs(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// normalizeURL returns raw in the form the proxy sees it in a request line,
+// which is what rules match against and the cache key is derived from.
+func normalizeURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid URL %q: want an absolute http or https URL", raw)
+	}
+	return u.String(), nil
+}
+
+func printDecision(d proxy.Decision) {
+	action := d.Action
+	if d.Rule != "" {
+		action += " (" + d.Rule + ")"
+	}
+	connect := "refused"
+	if d.ConnectAllowed {
+		connect = "allowed"
+	}
+	if d.ConnectRule != "" {
+		connect += " (" + d.ConnectRule + ")"
+	}
+
+	fmt.Println(d.URL)
+	fmt.Printf("  action:      %s\n", action)
+	fmt.Printf("  passthrough: %t\n", d.Passthrough)
+	fmt.Printf("  connect:     %s\n", connect)
+	if !d.Passthrough && !d.Denied {
+		fmt.Printf("  ttl:         %s (%s)\n", d.TTLString, d.TTLRule)
+	}
+	fmt.Printf("  key:         %s\n", d.Key)
+	if d.Mirror != "" {
+		fmt.Printf("  mirror:      %s\n", d.Mirror)
+	}
+	for _, rule := range d.ResponseRules {
+		fmt.Printf("  may change:  %s, depending on the response\n", rule)
+	}
+}
@@ -3,6 +3,7 @@ module cascade
 go 1.21
 
 require (
+	golang.org/x/crypto v0.15.0
 	golang.org/x/net v0.18.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,212 @@
+// Package accesslog writes one line per proxied request in Squid native,
+// Apache combined or JSON Lines format, separate from the diagnostic log.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatSquid    = "squid"
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+)
+
+// ValidFormat reports whether format names a supported log format.
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatSquid, FormatCombined, FormatJSON:
+		return true
+	}
+	return false
+}
+
+// Record describes one request handled by the proxy.
+type Record struct {
+	Time         time.Time     `json:"time"`
+	ClientIP     string        `json:"client_ip"`
+	User         string        `json:"user,omitempty"`
+	Method       string        `json:"method"`
+	URL          string        `json:"url"`
+	Proto        string        `json:"proto"`
+	Status       int           `json:"status"`
+	Bytes        int64         `json:"bytes"`
+	Duration     time.Duration `json:"-"`
+	Outcome      string        `json:"cache"`
+	UpstreamHost string        `json:"upstream_host,omitempty"`
+	UpstreamTime time.Duration `json:"-"`
+	ContentType  string        `json:"content_type,omitempty"`
+	Referer      string        `json:"referer,omitempty"`
+	UserAgent    string        `json:"user_agent,omitempty"`
+}
+
+// Logger appends records to a file. It is safe for concurrent use.
+type Logger struct {
+	mu     sync.Mutex
+	path   string
+	format string
+	out    io.Writer
+	file   *os.File
+}
+
+// Open opens path for appending. A path of "-" logs to stdout.
+func Open(path, format string) (*Logger, error) {
+	if !ValidFormat(format) {
+		return nil, fmt.Errorf("unsupported access log format: %s", format)
+	}
+
+	l := &Logger{path: path, format: format}
+	if path == "-" {
+		l.out = os.Stdout
+		return l, nil
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	l.file = file
+	l.out = file
+	return nil
+}
+
+// Reopen closes and reopens the log file, for use after logrotate has moved
+// it away.
+func (l *Logger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.out = io.Discard
+	return err
+}
+
+// Log writes rec as a single line.
+func (l *Logger) Log(rec *Record) {
+	var line string
+	switch l.format {
+	case FormatSquid:
+		line = formatSquid(rec)
+	case FormatCombined:
+		line = formatCombined(rec)
+	case FormatJSON:
+		line = formatJSON(rec)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line+"\n")
+}
+
+// formatSquid renders the Squid native format:
+//
+//	time elapsed client action/code bytes method URL user hierarchy/peer type
+func formatSquid(rec *Record) string {
+	hierarchy := "HIER_NONE/-"
+	if rec.UpstreamHost != "" {
+		hierarchy = "HIER_DIRECT/" + rec.UpstreamHost
+	}
+
+	return fmt.Sprintf("%d.%03d %6d %s %s/%03d %d %s %s %s %s %s",
+		rec.Time.Unix(), rec.Time.Nanosecond()/int(time.Millisecond),
+		rec.Duration.Milliseconds(),
+		dash(rec.ClientIP),
+		squidAction(rec.Outcome), rec.Status,
+		rec.Bytes,
+		rec.Method,
+		rec.URL,
+		dash(rec.User),
+		hierarchy,
+		dash(rec.ContentType))
+}
+
+func squidAction(outcome string) string {
+	switch outcome {
+	case "hit":
+		return "TCP_HIT"
+	case "stale":
+		return "TCP_REFRESH_FAIL_OLD"
+	case "miss":
+		return "TCP_MISS"
+	case "passthrough":
+		return "TCP_MISS"
+	case "connect":
+		return "TCP_TUNNEL"
+	case "denied", "limited":
+		return "TCP_DENIED"
+	}
+	return "NONE"
+}
+
+// formatCombined renders the Apache combined log format.
+func formatCombined(rec *Record) string {
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d "%s" "%s"`,
+		dash(rec.ClientIP),
+		dash(rec.User),
+		rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		rec.Method, escapeQuotes(rec.URL), rec.Proto,
+		rec.Status,
+		rec.Bytes,
+		dash(escapeQuotes(rec.Referer)),
+		dash(escapeQuotes(rec.UserAgent)))
+}
+
+func formatJSON(rec *Record) string {
+	line := struct {
+		*Record
+		DurationMS float64 `json:"duration_ms"`
+		UpstreamMS float64 `json:"upstream_ms,omitempty"`
+	}{
+		Record:     rec,
+		DurationMS: float64(rec.Duration.Microseconds()) / 1000,
+		UpstreamMS: float64(rec.UpstreamTime.Microseconds()) / 1000,
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(data)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func escapeQuotes(s string) string {
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
@@ -0,0 +1,443 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cascade/internal/cache"
+	"cascade/internal/config"
+	"cascade/internal/logging"
+	"cascade/internal/metrics"
+	"cascade/internal/proxy"
+
+	"gopkg.in/yaml.v3"
+)
+
+var logger = logging.For("admin")
+
+// Server is the admin HTTP API. It is served on its own listener, separate
+// from the proxy port, and has its own authentication.
+type Server struct {
+	storage  *cache.Storage
+	proxy    *proxy.Proxy
+	reloader func() (ReloadResult, error)
+	mux      *http.ServeMux
+}
+
+// New returns the admin API. Credentials are read from the proxy's current
+// configuration, so a reload changes them.
+func New(storage *cache.Storage, p *proxy.Proxy) *Server {
+	s := &Server{
+		storage: storage,
+		proxy:   p,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/api/stats", s.handleStats)
+	s.mux.HandleFunc("/api/entries", s.handleEntries)
+	s.mux.HandleFunc("/api/entry", s.handleEntry)
+	s.mux.HandleFunc("/api/purge", s.handlePurge)
+	s.mux.HandleFunc("/api/refresh", s.handleRefresh)
+	s.mux.HandleFunc("/api/config", s.handleConfig)
+	s.mux.HandleFunc("/api/rules/eval", s.handleRulesEval)
+	s.mux.HandleFunc("/api/profiles", s.handleProfiles)
+	s.mux.HandleFunc("/api/log", s.handleLog)
+	s.mux.HandleFunc("/api/reload", s.handleReload)
+	s.mux.HandleFunc("/api/dashboard", s.handleDashboardData)
+	s.mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", dashboardHandler()))
+	s.mux.HandleFunc("/", s.handleRoot)
+	s.mux.Handle("/metrics", metrics.Default.Handler())
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := s.proxy.Config().Admin
+	if !authorized(cfg, r) {
+		if cfg.Username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cascade admin"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cascade admin"`)
+		}
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized accepts the request if no credentials are configured, or if it
+// carries either the configured bearer token or Basic credentials.
+func authorized(cfg config.AdminConfig, r *http.Request) bool {
+	if cfg.Token == "" && cfg.Username == "" {
+		return true
+	}
+
+	if cfg.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, cfg.Token) {
+			return true
+		}
+	}
+
+	if cfg.Username != "" {
+		if user, pass, ok := r.BasicAuth(); ok && secureEqual(user, cfg.Username) && secureEqual(pass, cfg.Password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Stats is the response body of /api/stats.
+type Stats struct {
+	SizeBytes     int64   `json:"size_bytes"`
+	CapacityBytes int64   `json:"capacity_bytes"`
+	Entries       int     `json:"entries"`
+	UsagePercent  float64 `json:"usage_percent"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.cacheStats())
+}
+
+func (s *Server) cacheStats() Stats {
+	size, capacity, entries := s.storage.GetStats()
+	stats := Stats{
+		SizeBytes:     size,
+		CapacityBytes: capacity,
+		Entries:       entries,
+	}
+	if capacity > 0 {
+		stats.UsagePercent = float64(size) * 100 / float64(capacity)
+	}
+	return stats
+}
+
+func (s *Server) handleEntries(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	entries, err := s.storage.List(filter, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (s *Server) handleEntry(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "missing url parameter")
+		return
+	}
+
+	entry, err := s.storage.Lookup(target)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "not cached")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// PurgeResult is the response body of /api/purge.
+type PurgeResult struct {
+	Purged int   `json:"purged"`
+	Bytes  int64 `json:"bytes"`
+}
+
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	q := r.URL.Query()
+	if target := q.Get("url"); target != "" {
+		entry, err := s.storage.Lookup(target)
+		if os.IsNotExist(err) {
+			writeJSON(w, http.StatusOK, PurgeResult{})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := s.storage.Delete(target); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, PurgeResult{Purged: 1, Bytes: entry.Size})
+		return
+	}
+
+	filter, err := ParseFilter(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.IsZero() {
+		writeError(w, http.StatusBadRequest, "refusing to purge without url, pattern or host")
+		return
+	}
+
+	count, bytes, err := s.storage.Purge(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, PurgeResult{Purged: count, Bytes: bytes})
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "missing url parameter")
+		return
+	}
+
+	entry, err := s.proxy.Refresh(target)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	// Round-trip through YAML so the output uses the configuration file's
+	// key names and duration syntax.
+	data, err := yaml.Marshal(s.proxy.Config().Redacted())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (s *Server) handleRulesEval(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "missing url parameter")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.proxy.Evaluate(target))
+}
+
+func (s *Server) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.proxy.Profiles())
+}
+
+// LogSettings is the response body of /api/log.
+type LogSettings struct {
+	Level  string          `json:"level"`
+	Format string          `json:"format"`
+	Debug  map[string]bool `json:"debug"`
+}
+
+// SetReloader enables /api/reload, which calls reload to re-read the
+// configuration file.
+func (s *Server) SetReloader(reload func() (ReloadResult, error)) {
+	s.reloader = reload
+}
+
+// ReloadResult is the response body of /api/reload.
+type ReloadResult struct {
+	// RestartRequired lists changed settings that only take effect after a
+	// restart.
+	RestartRequired []string `json:"restart_required"`
+	Warnings        []string `json:"warnings"`
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if s.reloader == nil {
+		writeError(w, http.StatusNotImplemented, "reload is not available")
+		return
+	}
+
+	result, err := s.reloader()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleLog reports the diagnostic log settings on GET. POST changes the
+// global level with ?level= and toggles one subsystem's debug output with
+// ?subsystem=&debug=true|false.
+func (s *Server) handleLog(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		q := r.URL.Query()
+		if v := q.Get("level"); v != "" {
+			level, err := logging.ParseLevel(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			logging.SetLevel(level)
+			logger.Info("log level changed", "level", level)
+		}
+		if name := q.Get("subsystem"); name != "" {
+			on, err := strconv.ParseBool(q.Get("debug"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "debug must be true or false")
+				return
+			}
+			if err := logging.SetDebug(name, on); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			logger.Info("debug logging toggled", "target", name, "debug", on)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, LogSettings{
+		Level:  strings.ToLower(logging.Level().String()),
+		Format: logging.Format(),
+		Debug:  logging.Subsystems(),
+	})
+}
+
+// ParseFilter builds an entry filter from the pattern, host, min_size,
+// max_size, older_than and newer_than query parameters.
+func ParseFilter(q url.Values) (cache.EntryFilter, error) {
+	filter := cache.EntryFilter{
+		URL:  q.Get("pattern"),
+		Host: q.Get("host"),
+	}
+
+	var err error
+	if v := q.Get("min_size"); v != "" {
+		if filter.MinSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid min_size: %w", err)
+		}
+	}
+	if v := q.Get("max_size"); v != "" {
+		if filter.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid max_size: %w", err)
+		}
+	}
+	if v := q.Get("older_than"); v != "" {
+		if filter.OlderThan, err = time.ParseDuration(v); err != nil {
+			return filter, fmt.Errorf("invalid older_than: %w", err)
+		}
+	}
+	if v := q.Get("newer_than"); v != "" {
+		if filter.NewerThan, err = time.ParseDuration(v); err != nil {
+			return filter, fmt.Errorf("invalid newer_than: %w", err)
+		}
+	}
+
+	return filter, nil
+}
+
+// FilterQuery is the inverse of ParseFilter.
+func FilterQuery(filter cache.EntryFilter) url.Values {
+	q := url.Values{}
+	if filter.URL != "" {
+		q.Set("pattern", filter.URL)
+	}
+	if filter.Host != "" {
+		q.Set("host", filter.Host)
+	}
+	if filter.MinSize > 0 {
+		q.Set("min_size", strconv.FormatInt(filter.MinSize, 10))
+	}
+	if filter.MaxSize > 0 {
+		q.Set("max_size", strconv.FormatInt(filter.MaxSize, 10))
+	}
+	if filter.OlderThan > 0 {
+		q.Set("older_than", filter.OlderThan.String())
+	}
+	if filter.NewerThan > 0 {
+		q.Set("newer_than", filter.NewerThan.String())
+	}
+	return q
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
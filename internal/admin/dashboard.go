@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"cascade/internal/proxy"
+)
+
+// The dashboard is plain HTML, CSS and JavaScript with no external
+// dependencies, so it works on networks without internet access.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
+
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	http.Redirect(w, r, "/dashboard/", http.StatusFound)
+}
+
+// DashboardData is the response body of /api/dashboard.
+type DashboardData struct {
+	proxy.Snapshot
+	Cache Stats `json:"cache"`
+}
+
+func (s *Server) handleDashboardData(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, DashboardData{
+		Snapshot: s.proxy.Snapshot(),
+		Cache:    s.cacheStats(),
+	})
+}
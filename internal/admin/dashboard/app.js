@@ -0,0 +1,202 @@
+// Polls /api/dashboard and renders it. Rates are computed from the difference
+// between consecutive samples, so "live" figures cover the last few minutes.
+(function () {
+  "use strict";
+
+  var POLL_MS = 2000;
+  var HISTORY = 150; // samples kept for the live window and chart
+
+  var samples = [];
+  var view = { hosts: "by_hits", objects: "by_hits" };
+  var last = null;
+
+  function $(id) { return document.getElementById(id); }
+
+  function formatBytes(n) {
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+    return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+  }
+
+  function formatPercent(x) {
+    return isFinite(x) ? (x * 100).toFixed(1) + "%" : "–";
+  }
+
+  function formatDuration(ms) {
+    var s = Math.floor(ms / 1000);
+    var d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+    if (d > 0) return d + "d " + h + "h";
+    if (h > 0) return h + "h " + m + "m";
+    return m + "m " + (s % 60) + "s";
+  }
+
+  function isSet(t) { return t && new Date(t).getFullYear() > 1970; }
+
+  function count(req, outcome) { return req[outcome] || 0; }
+
+  function setText(id, text) { $(id).textContent = text; }
+
+  function row(cells, className) {
+    var tr = document.createElement("tr");
+    cells.forEach(function (c) {
+      var td = document.createElement("td");
+      td.textContent = c;
+      td.title = c;
+      if (className) td.className = className;
+      tr.appendChild(td);
+    });
+    return tr;
+  }
+
+  function fillTable(id, rows, columns) {
+    var body = $(id).querySelector("tbody");
+    body.textContent = "";
+    if (!rows || rows.length === 0) {
+      var tr = row(["No data yet"], "empty");
+      tr.firstChild.colSpan = columns;
+      body.appendChild(tr);
+      return;
+    }
+    rows.forEach(function (r) { body.appendChild(r); });
+  }
+
+  function renderTop(id, lists) {
+    var items = lists ? lists[view[id]] : [];
+    fillTable(id, (items || []).map(function (it) {
+      return row([it.key, it.hits, it.requests, formatBytes(it.bytes)]);
+    }), 4);
+  }
+
+  function drawChart(points) {
+    var canvas = $("hit-ratio-chart");
+    var ctx = canvas.getContext("2d");
+    var w = canvas.width, h = canvas.height;
+    ctx.clearRect(0, 0, w, h);
+    ctx.strokeStyle = "#dde3ea";
+    ctx.beginPath();
+    ctx.moveTo(0, h - 0.5);
+    ctx.lineTo(w, h - 0.5);
+    ctx.stroke();
+
+    var valid = points.filter(function (p) { return p !== null; });
+    if (valid.length < 2) return;
+
+    ctx.strokeStyle = "#1f7a8c";
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    var started = false;
+    points.forEach(function (p, i) {
+      if (p === null) return;
+      var x = i * w / (HISTORY - 1);
+      var y = h - 2 - p * (h - 4);
+      if (started) { ctx.lineTo(x, y); } else { ctx.moveTo(x, y); started = true; }
+    });
+    ctx.stroke();
+  }
+
+  function render(data) {
+    var now = Date.now();
+    var req = data.requests || {};
+    var hits = count(req, "hit"), misses = count(req, "miss");
+
+    samples.push({ time: now, hits: hits, misses: misses });
+    if (samples.length > HISTORY) samples.shift();
+
+    // Live ratio over the retained window.
+    var first = samples[0];
+    var dh = hits - first.hits, dm = misses - first.misses;
+    setText("hit-ratio-live", dh + dm > 0 ? formatPercent(dh / (dh + dm)) : "idle");
+    setText("window", formatDuration(now - first.time));
+    setText("hit-ratio-total", formatPercent(hits / (hits + misses)));
+
+    // Per-interval ratios for the chart, padded on the left.
+    var points = [];
+    for (var i = 1; i < samples.length; i++) {
+      var h = samples[i].hits - samples[i - 1].hits;
+      var m = samples[i].misses - samples[i - 1].misses;
+      points.push(h + m > 0 ? h / (h + m) : null);
+    }
+    while (points.length < HISTORY) points.unshift(null);
+    drawChart(points);
+
+    var served = data.cache_bytes + data.upstream_bytes;
+    setText("saved", formatBytes(data.cache_bytes));
+    setText("saved-percent", formatPercent(data.cache_bytes / served));
+    setText("upstream-bytes", formatBytes(data.upstream_bytes));
+
+    var cache = data.cache;
+    setText("fill-percent", cache.usage_percent.toFixed(1) + "%");
+    $("fill-bar").style.width = Math.min(cache.usage_percent, 100) + "%";
+    setText("fill-size", formatBytes(cache.size_bytes));
+    setText("fill-capacity", formatBytes(cache.capacity_bytes));
+    setText("entries", cache.entries);
+
+    setText("inflight", data.inflight_downloads);
+    setText("requests", Object.keys(req).sort().map(function (k) {
+      return req[k] + " " + k;
+    }).join(" · ") || "no requests yet");
+
+    var eg = data.egress;
+    var state = $("egress-state");
+    if (eg.consecutive_failures > 0) {
+      state.textContent = "failing";
+      state.className = "value bad";
+    } else if (isSet(eg.last_success)) {
+      state.textContent = "healthy";
+      state.className = "value good";
+    } else {
+      state.textContent = "unused";
+      state.className = "value";
+    }
+    var detail = eg.type + (eg.proxy ? " via " + eg.proxy : "") + " · " +
+      eg.dials + " dials, " + eg.failures + " failed";
+    if (isSet(eg.last_failure)) {
+      detail += " · last error " + new Date(eg.last_failure).toLocaleTimeString() + ": " + eg.last_error;
+    }
+    setText("egress-detail", detail);
+
+    renderTop("hosts", data.top_hosts);
+    renderTop("objects", data.top_objects);
+
+    fillTable("errors", (data.recent_errors || []).map(function (e) {
+      return row([new Date(e.time).toLocaleTimeString(), e.method + " " + e.url, e.status, e.message]);
+    }), 4);
+
+    setText("uptime", "up " + formatDuration(now - new Date(data.started_at).getTime()));
+  }
+
+  function poll() {
+    fetch("../api/dashboard", { credentials: "same-origin", cache: "no-store" })
+      .then(function (resp) {
+        if (!resp.ok) throw new Error("HTTP " + resp.status);
+        return resp.json();
+      })
+      .then(function (data) {
+        last = data;
+        render(data);
+        setText("status", "updated " + new Date().toLocaleTimeString());
+      })
+      .catch(function (err) {
+        setText("status", "update failed: " + err.message);
+      })
+      .then(function () { setTimeout(poll, POLL_MS); });
+  }
+
+  document.querySelectorAll(".toggle").forEach(function (toggle) {
+    toggle.addEventListener("click", function (ev) {
+      var by = ev.target.getAttribute("data-by");
+      if (!by) return;
+      view[toggle.getAttribute("data-target")] = by;
+      toggle.querySelectorAll("button").forEach(function (b) {
+        b.classList.toggle("active", b === ev.target);
+      });
+      if (last) {
+        renderTop("hosts", last.top_hosts);
+        renderTop("objects", last.top_objects);
+      }
+    });
+  });
+
+  poll();
+})();
@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	quarantineDir       = "quarantine"
+	quarantineRetention = 7 * 24 * time.Hour
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// digestNames maps checksum algorithms to their names in the HTTP digest
+// algorithm registry used by Repr-Digest (RFC 9530) and Digest (RFC 3230).
+var digestNames = map[string]string{
+	"sha256": "sha-256",
+	"sha512": "sha-512",
+}
+
+// ValidChecksumAlgorithm reports whether algo can be used for cache checksums.
+// "none" and the empty string disable checksumming.
+func ValidChecksumAlgorithm(algo string) bool {
+	if algo == "" || algo == "none" {
+		return true
+	}
+	_, ok := checksumAlgorithms[algo]
+	return ok
+}
+
+// SetChecksum selects the digest computed for new cache objects.
+func (s *Storage) SetChecksum(algo string) error {
+	if !ValidChecksumAlgorithm(algo) {
+		return fmt.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+	if algo == "none" {
+		algo = ""
+	}
+	s.settingsMu.Lock()
+	s.checksum = algo
+	s.settingsMu.Unlock()
+	return nil
+}
+
+// SetVerifyOnRead makes Get re-hash the data file before serving it.
+func (s *Storage) SetVerifyOnRead(verify bool) {
+	s.settingsMu.Lock()
+	s.verifyOnRead = verify
+	s.settingsMu.Unlock()
+}
+
+// SetCorruptionHandler registers fn to be called after the scrubber
+// quarantines a corrupt object, typically to refetch it.
+func (s *Storage) SetCorruptionHandler(fn func(entry *CacheEntry)) {
+	s.onCorrupt = fn
+}
+
+// newHash returns a hash for the configured checksum algorithm and its name,
+// or nil if checksums are off.
+func (s *Storage) newHash() (hash.Hash, string) {
+	s.settingsMu.RLock()
+	algo := s.checksum
+	s.settingsMu.RUnlock()
+
+	if algo == "" {
+		return nil, ""
+	}
+	return checksumAlgorithms[algo](), algo
+}
+
+// DigestHeader returns the Repr-Digest field value for the entry, or "" when
+// no checksum was recorded.
+func (e *CacheEntry) DigestHeader() string {
+	name, sum, ok := e.digest()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s=:%s:", name, base64.StdEncoding.EncodeToString(sum))
+}
+
+// LegacyDigestHeader returns the RFC 3230 Digest field value for the entry.
+func (e *CacheEntry) LegacyDigestHeader() string {
+	name, sum, ok := e.digest()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s=%s", strings.ToUpper(name), base64.StdEncoding.EncodeToString(sum))
+}
+
+func (e *CacheEntry) digest() (string, []byte, bool) {
+	name, ok := digestNames[e.ChecksumAlgorithm]
+	if !ok || e.Checksum == "" {
+		return "", nil, false
+	}
+	sum, err := hex.DecodeString(e.Checksum)
+	if err != nil {
+		return "", nil, false
+	}
+	return name, sum, true
+}
+
+// verifyData checks the data file against the size and checksum recorded in
+// the entry. The file offset is left at the start of the file.
+func verifyData(entry *CacheEntry, file *os.File, bufferSize int, full bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != entry.Size {
+		return fmt.Errorf("size mismatch: %d bytes on disk, %d bytes recorded", info.Size(), entry.Size)
+	}
+
+	if !full || entry.Checksum == "" {
+		return nil
+	}
+
+	newHash, ok := checksumAlgorithms[entry.ChecksumAlgorithm]
+	if !ok {
+		return nil
+	}
+
+	h := newHash()
+	if _, err := io.CopyBuffer(h, file, make([]byte, bufferSize)); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != entry.Checksum {
+		return fmt.Errorf("checksum mismatch: %s %s, recorded %s", entry.ChecksumAlgorithm, sum, entry.Checksum)
+	}
+	return nil
+}
+
+// quarantine moves a corrupt object out of the cache so it is neither served
+// nor counted, while keeping it around for inspection. The caller must hold
+// the lock for dataPath.
+func (s *Storage) quarantine(key, dataPath, metaPath string, reason error) {
+	dir := filepath.Join(s.baseDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		os.Remove(dataPath)
+		os.Remove(metaPath)
+	} else {
+		now := time.Now()
+		stamp := now.UTC().Format("20060102T150405")
+		for src, dst := range map[string]string{
+			dataPath: filepath.Join(dir, key+"-"+stamp+dataSuffix),
+			metaPath: filepath.Join(dir, key+"-"+stamp+metaSuffix),
+		} {
+			if err := os.Rename(src, dst); err != nil {
+				os.Remove(src)
+				continue
+			}
+			// Retention is measured from the time of quarantine.
+			os.Chtimes(dst, now, now)
+		}
+	}
+	s.lru.Remove(key)
+
+	logger.Warn("quarantined corrupt object", "key", key, "err", reason)
+}
+
+// Scrub re-verifies every cached object against its recorded checksum,
+// quarantining the ones that fail. Objects that are locked are skipped. It
+// returns the number of objects checked and quarantined.
+func (s *Storage) Scrub() (int, int, error) {
+	var checked, corrupt int
+
+	err := filepath.Walk(s.baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(s.baseDir, quarantineDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+
+		key := strings.TrimSuffix(filepath.Base(path), metaSuffix)
+		dataPath, metaPath := s.getFilePath(key)
+
+		unlock, ok, err := s.fileLock.TryLock(dataPath)
+		if err != nil || !ok {
+			return nil
+		}
+		defer unlock()
+
+		entry, err := LoadCacheEntry(metaPath)
+		if err != nil {
+			return nil
+		}
+
+		file, err := os.Open(dataPath)
+		if err != nil {
+			return nil
+		}
+		verr := verifyData(entry, file, s.bufferSize, true)
+		file.Close()
+
+		checked++
+		if verr != nil {
+			corrupt++
+			s.quarantine(key, dataPath, metaPath, verr)
+			if s.onCorrupt != nil {
+				go s.onCorrupt(entry)
+			}
+		}
+		return nil
+	})
+
+	return checked, corrupt, err
+}
+
+// StartScrubber runs Scrub every interval until Close is called.
+func (s *Storage) StartScrubber(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				checked, corrupt, err := s.Scrub()
+				if err != nil {
+					logger.Error("scrub failed", "err", err)
+					continue
+				}
+				logger.Info("scrubbed cache", "checked", checked, "quarantined", corrupt)
+			}
+		}
+	}()
+}
+
+// purgeQuarantine removes quarantined objects older than quarantineRetention.
+func (s *Storage) purgeQuarantine(stats *ScavengeStats) {
+	dir := filepath.Join(s.baseDir, quarantineDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-quarantineRetention)
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || info.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if size, removed := removeFile(filepath.Join(dir, f.Name())); removed {
+			stats.Quarantined++
+			stats.Bytes += size
+		}
+	}
+}
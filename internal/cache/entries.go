@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cascade/internal/match"
+)
+
+// errStopWalk ends a Walk early without reporting an error.
+var errStopWalk = errors.New("stop walk")
+
+// EntryFilter selects cache entries. Zero-valued fields match everything.
+type EntryFilter struct {
+	URL       string        // glob matched against the whole URL
+	Host      string        // glob matched against the whole URL host, ignoring case
+	MinSize   int64         // bytes
+	MaxSize   int64         // bytes
+	OlderThan time.Duration // created at least this long ago
+	NewerThan time.Duration // created at most this long ago
+}
+
+// IsZero reports whether the filter would match every entry.
+func (f EntryFilter) IsZero() bool {
+	return f == EntryFilter{}
+}
+
+func (f EntryFilter) Match(e *CacheEntry) bool {
+	if f.URL != "" && !match.Wildcard(e.URL, f.URL) {
+		return false
+	}
+	if f.Host != "" {
+		u, err := url.Parse(e.URL)
+		if err != nil || !match.Wildcard(strings.ToLower(u.Hostname()), strings.ToLower(f.Host)) {
+			return false
+		}
+	}
+	if f.MinSize > 0 && e.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && e.Size > f.MaxSize {
+		return false
+	}
+	age := time.Since(e.CreatedAt)
+	if f.OlderThan > 0 && age < f.OlderThan {
+		return false
+	}
+	if f.NewerThan > 0 && age > f.NewerThan {
+		return false
+	}
+	return true
+}
+
+// Walk calls fn with the metadata of every cached object. Unreadable metadata
+// is skipped. Returning a non-nil error from fn stops the walk.
+func (s *Storage) Walk(fn func(entry *CacheEntry) error) error {
+	err := filepath.Walk(s.baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(s.baseDir, quarantineDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+
+		entry, err := LoadCacheEntry(path)
+		if err != nil {
+			return nil
+		}
+		return fn(entry)
+	})
+	if errors.Is(err, errStopWalk) {
+		return nil
+	}
+	return err
+}
+
+// List returns the entries matching filter, at most limit of them when limit
+// is positive.
+func (s *Storage) List(filter EntryFilter, limit int) ([]*CacheEntry, error) {
+	entries := []*CacheEntry{}
+	err := s.Walk(func(entry *CacheEntry) error {
+		if !filter.Match(entry) {
+			return nil
+		}
+		entries = append(entries, entry)
+		if limit > 0 && len(entries) >= limit {
+			return errStopWalk
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Lookup returns the metadata stored for url without touching its access
+// time or taking the object lock.
+func (s *Storage) Lookup(url string) (*CacheEntry, error) {
+	_, metaPath := s.getFilePath(Key(url))
+	return LoadCacheEntry(metaPath)
+}
+
+// Purge deletes every entry matching filter and returns how many entries and
+// bytes were removed.
+func (s *Storage) Purge(filter EntryFilter) (int, int64, error) {
+	entries, err := s.List(filter, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var count int
+	var bytes int64
+	for _, entry := range entries {
+		if err := s.Delete(entry.URL); err != nil {
+			return count, bytes, err
+		}
+		count++
+		bytes += entry.Size
+	}
+	return count, bytes, nil
+}
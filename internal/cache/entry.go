@@ -2,7 +2,9 @@ package cache
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -16,18 +18,29 @@ type CacheEntry struct {
 	CreatedAt   time.Time         `json:"created_at"`
 	AccessedAt  time.Time         `json:"accessed_at"`
 	ExpiresAt   time.Time         `json:"expires_at"`
+
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty"`
+	Checksum          string `json:"checksum,omitempty"`
 }
 
 func (e *CacheEntry) IsExpired() bool {
 	return time.Now().After(e.ExpiresAt)
 }
 
+// Save atomically and durably writes the entry metadata to metaPath.
 func (e *CacheEntry) Save(metaPath string) error {
+	return e.save(metaPath, true)
+}
+
+// save writes the metadata through a temp file and a rename so readers never
+// observe a truncated .meta file. When durable is set the data and the
+// directory entry are fsynced before returning.
+func (e *CacheEntry) save(metaPath string, durable bool) error {
 	data, err := json.MarshalIndent(e, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(metaPath, data, 0644)
+	return writeFileAtomic(metaPath, data, 0644, durable)
 }
 
 func LoadCacheEntry(metaPath string) (*CacheEntry, error) {
@@ -43,3 +56,55 @@ func LoadCacheEntry(metaPath string) (*CacheEntry, error) {
 
 	return &entry, nil
 }
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode, durable bool) error {
+	tempPath := path + tempSuffix
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+
+	if durable {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tempPath)
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if durable {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// syncDir fsyncs a directory so that renames and unlinks inside it survive a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
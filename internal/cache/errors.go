@@ -0,0 +1,19 @@
+package cache
+
+import "errors"
+
+// Errors returned by Get and Put. They are wrapped with details, so compare
+// them with errors.Is.
+var (
+	ErrNotFound = errors.New("cache entry not found")
+	ErrExpired  = errors.New("cache entry expired")
+	ErrCorrupt  = errors.New("cache entry corrupt")
+
+	// ErrEmpty and ErrIncomplete mean the upstream body was not received
+	// in full; ErrTooSmall and ErrTooLarge mean it fell outside the
+	// configured object size limits.
+	ErrEmpty      = errors.New("refusing to cache empty file")
+	ErrIncomplete = errors.New("incomplete download")
+	ErrTooSmall   = errors.New("file too small to cache")
+	ErrTooLarge   = errors.New("file too large to cache")
+)
@@ -90,10 +90,24 @@ func (l *LRU) Size() int64 {
 	return l.size
 }
 
+func (l *LRU) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.items)
+}
+
 func (l *LRU) Capacity() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 	return l.capacity
 }
 
+func (l *LRU) SetCapacity(capacity int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.capacity = capacity
+}
+
 func (l *LRU) NeedsEviction() bool {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -0,0 +1,31 @@
+package cache
+
+import "cascade/internal/metrics"
+
+var (
+	evictionsTotal = metrics.Default.NewCounter(
+		"cascade_cache_evictions_total",
+		"Objects evicted from the cache to make room for new ones.")
+	evictedBytesTotal = metrics.Default.NewCounter(
+		"cascade_cache_evicted_bytes_total",
+		"Bytes evicted from the cache to make room for new ones.")
+	lockWaitSeconds = metrics.Default.NewHistogramVec(
+		"cascade_cache_lock_wait_seconds",
+		"Time spent waiting for a cache object lock.",
+		[]float64{.0001, .001, .01, .1, 1, 10, 60, 300},
+		"op")
+)
+
+// RegisterMetrics exposes the LRU size, capacity and entry count of s as
+// gauges in r.
+func (s *Storage) RegisterMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("cascade_cache_size_bytes", "Bytes currently stored in the cache.", func() float64 {
+		return float64(s.lru.Size())
+	})
+	r.NewGaugeFunc("cascade_cache_capacity_bytes", "Configured cache capacity in bytes.", func() float64 {
+		return float64(s.lru.Capacity())
+	})
+	r.NewGaugeFunc("cascade_cache_entries", "Objects currently stored in the cache.", func() float64 {
+		return float64(s.lru.Len())
+	})
+}
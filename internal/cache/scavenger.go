@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ScavengeStats summarises what a scavenger pass removed from the cache
+// directory.
+type ScavengeStats struct {
+	OrphanData  int   `json:"orphan_data"`
+	OrphanMeta  int   `json:"orphan_meta"`
+	TempFiles   int   `json:"temp_files"`
+	LockFiles   int   `json:"lock_files"`
+	Quarantined int   `json:"quarantined"`
+	Bytes       int64 `json:"bytes"`
+}
+
+func (st ScavengeStats) Removed() int {
+	return st.OrphanData + st.OrphanMeta + st.TempFiles + st.LockFiles + st.Quarantined
+}
+
+func (st ScavengeStats) String() string {
+	return fmt.Sprintf("removed %d orphaned data, %d orphaned meta, %d temp, %d lock and %d expired quarantine files, reclaimed %d bytes",
+		st.OrphanData, st.OrphanMeta, st.TempFiles, st.LockFiles, st.Quarantined, st.Bytes)
+}
+
+// shardFiles records which of the files belonging to one cache key exist on
+// disk.
+type shardFiles struct {
+	data, meta, dataTemp, metaTemp, lock bool
+}
+
+func (f shardFiles) suspicious() bool {
+	return f.dataTemp || f.metaTemp || f.lock || f.data != f.meta
+}
+
+// Scavenge removes files left behind by a crash: data files without metadata,
+// metadata without data, leftover temp files and stale lock files. Keys that
+// are currently locked, by this process or another one, are skipped. Objects
+// that have been in quarantine longer than quarantineRetention are deleted.
+func (s *Storage) Scavenge() (ScavengeStats, error) {
+	var stats ScavengeStats
+
+	shards, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShardName(shard.Name()) {
+			continue
+		}
+
+		dir := filepath.Join(s.baseDir, shard.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return stats, err
+		}
+
+		keys := make(map[string]*shardFiles)
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			key, kind, ok := splitCacheFileName(f.Name())
+			if !ok {
+				continue
+			}
+			sf, exists := keys[key]
+			if !exists {
+				sf = &shardFiles{}
+				keys[key] = sf
+			}
+			switch kind {
+			case dataSuffix:
+				sf.data = true
+			case metaSuffix:
+				sf.meta = true
+			case dataSuffix + tempSuffix:
+				sf.dataTemp = true
+			case metaSuffix + tempSuffix:
+				sf.metaTemp = true
+			case dataSuffix + lockSuffix:
+				sf.lock = true
+			}
+		}
+
+		for key, sf := range keys {
+			if !sf.suspicious() {
+				continue
+			}
+			if err := s.scavengeKey(key, &stats); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	s.purgeQuarantine(&stats)
+
+	return stats, nil
+}
+
+func (s *Storage) scavengeKey(key string, stats *ScavengeStats) error {
+	dataPath, metaPath := s.getFilePath(key)
+	lockPath := dataPath + lockSuffix
+
+	_, lockErr := os.Stat(lockPath)
+	hadLock := lockErr == nil
+
+	unlock, ok, err := s.fileLock.TryLock(dataPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	for _, temp := range []string{dataPath + tempSuffix, metaPath + tempSuffix} {
+		if size, removed := removeFile(temp); removed {
+			stats.TempFiles++
+			stats.Bytes += size
+		}
+	}
+
+	_, dataErr := os.Stat(dataPath)
+	_, metaErr := os.Stat(metaPath)
+
+	switch {
+	case dataErr == nil && os.IsNotExist(metaErr):
+		if size, removed := removeFile(dataPath); removed {
+			stats.OrphanData++
+			stats.Bytes += size
+		}
+	case os.IsNotExist(dataErr) && metaErr == nil:
+		if size, removed := removeFile(metaPath); removed {
+			stats.OrphanMeta++
+			stats.Bytes += size
+		}
+		s.lru.Remove(key)
+	}
+
+	// The lock file itself is removed by unlock.
+	if hadLock {
+		stats.LockFiles++
+	}
+
+	return nil
+}
+
+// StartScavenger runs Scavenge every interval until Close is called.
+func (s *Storage) StartScavenger(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				stats, err := s.Scavenge()
+				if err != nil {
+					logger.Error("scavenge failed", "err", err)
+					continue
+				}
+				if stats.Removed() > 0 {
+					logger.Info("scavenged cache directory", "stats", stats)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops background maintenance goroutines.
+func (s *Storage) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func removeFile(path string) (int64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	if err := os.Remove(path); err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// splitCacheFileName splits "<key>.data.tmp" into the key and ".data.tmp".
+func splitCacheFileName(name string) (string, string, bool) {
+	idx := strings.IndexByte(name, '.')
+	if idx <= 0 {
+		return "", "", false
+	}
+	return name[:idx], name[idx:], true
+}
+
+func isShardName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -12,30 +14,63 @@ import (
 	"time"
 
 	"cascade/internal/lock"
+	"cascade/internal/logging"
+	"cascade/internal/tracing"
+)
+
+var logger = logging.For("cache")
+
+const (
+	dataSuffix = ".data"
+	metaSuffix = ".meta"
+	tempSuffix = ".tmp"
+	lockSuffix = ".lock"
 )
 
 type Storage struct {
-	baseDir     string
-	lru         *LRU
-	fileLock    *lock.FileLock
-	mu          sync.RWMutex
-	bufferSize  int
-	minFileSize int64
-	maxFileSize int64
+	baseDir    string
+	lru        *LRU
+	fileLock   *lock.FileLock
+	mu         sync.RWMutex
+	bufferSize int
+
+	// settingsMu guards the settings below, which a configuration reload
+	// can change while requests are running.
+	settingsMu   sync.RWMutex
+	minFileSize  int64
+	maxFileSize  int64
+	checksum     string
+	verifyOnRead bool
+	staleIfError time.Duration
+
+	onCorrupt func(entry *CacheEntry)
+
+	stopOnce sync.Once
+	stop     chan struct{}
 }
 
-func NewStorage(baseDir string, maxSizeBytes int64, bufferSizeKB int, minFileSizeKB, maxFileSizeMB int64) (*Storage, error) {
+func NewStorage(baseDir string, maxSizeBytes int64, bufferSizeKB int, minFileSizeKB, maxFileSizeMB int64, staleIfError time.Duration) (*Storage, error) {
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
 	s := &Storage{
-		baseDir:     baseDir,
-		lru:         NewLRU(maxSizeBytes),
-		fileLock:    lock.NewFileLock(),
-		bufferSize:  bufferSizeKB * 1024,
-		minFileSize: minFileSizeKB * 1024,
-		maxFileSize: maxFileSizeMB * 1024 * 1024,
+		baseDir:      baseDir,
+		lru:          NewLRU(maxSizeBytes),
+		fileLock:     lock.NewFileLock(),
+		bufferSize:   bufferSizeKB * 1024,
+		minFileSize:  minFileSizeKB * 1024,
+		maxFileSize:  maxFileSizeMB * 1024 * 1024,
+		staleIfError: staleIfError,
+		stop:         make(chan struct{}),
+	}
+
+	stats, err := s.Scavenge()
+	if err != nil {
+		return nil, fmt.Errorf("failed to scavenge cache directory: %w", err)
+	}
+	if stats.Removed() > 0 {
+		logger.Info("scavenged cache directory", "stats", stats)
 	}
 
 	if err := s.loadExistingCache(); err != nil {
@@ -45,19 +80,47 @@ func NewStorage(baseDir string, maxSizeBytes int64, bufferSizeKB int, minFileSiz
 	return s, nil
 }
 
+// OpenStorage opens an existing cache directory for offline maintenance. Unlike
+// NewStorage it neither scans, scavenges nor creates the directory, and the
+// LRU starts out empty.
+func OpenStorage(baseDir string, maxSizeBytes int64) (*Storage, error) {
+	info, err := os.Stat(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("cache directory %s is not a directory", baseDir)
+	}
+
+	return &Storage{
+		baseDir:    baseDir,
+		lru:        NewLRU(maxSizeBytes),
+		fileLock:   lock.NewFileLock(),
+		bufferSize: 64 * 1024,
+		stop:       make(chan struct{}),
+	}, nil
+}
+
 func (s *Storage) loadExistingCache() error {
 	return filepath.Walk(s.baseDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if !info.IsDir() && strings.HasSuffix(path, ".meta") {
+		if info.IsDir() && path == filepath.Join(s.baseDir, quarantineDir) {
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() && strings.HasSuffix(path, metaSuffix) {
 			entry, err := LoadCacheEntry(path)
 			if err != nil {
+				logger.Warn("removing unreadable metadata", "path", path, "err", err)
+				os.Remove(strings.TrimSuffix(path, metaSuffix) + dataSuffix)
+				os.Remove(path)
 				return nil
 			}
 
-			if entry.IsExpired() {
+			if s.tooStale(entry) {
 				s.deleteEntry(entry)
 				return nil
 			}
@@ -69,7 +132,8 @@ func (s *Storage) loadExistingCache() error {
 	})
 }
 
-func (s *Storage) generateKey(url string) string {
+// Key returns the cache key for url, which also names its files on disk.
+func Key(url string) string {
 	h := fnv.New128a()
 	h.Write([]byte(url))
 	sum := h.Sum(nil)
@@ -81,16 +145,41 @@ func (s *Storage) generateKey(url string) string {
 func (s *Storage) getFilePath(key string) (string, string) {
 	prefix := key[:2]
 	dir := filepath.Join(s.baseDir, prefix)
-	dataPath := filepath.Join(dir, key+".data")
-	metaPath := filepath.Join(dir, key+".meta")
+	dataPath := filepath.Join(dir, key+dataSuffix)
+	metaPath := filepath.Join(dir, key+metaSuffix)
 	return dataPath, metaPath
 }
 
-func (s *Storage) Get(url string) (*CacheEntry, io.ReadCloser, error) {
-	key := s.generateKey(url)
+// Get opens the cached object for url. The returned reader holds the object
+// lock until it is closed.
+func (s *Storage) Get(ctx context.Context, url string) (*CacheEntry, io.ReadCloser, error) {
+	return s.lookup(ctx, url, false)
+}
+
+// GetStale is Get for when the origin cannot be reached: it also opens an
+// object that has expired, if it expired less than the stale-if-error time
+// ago.
+func (s *Storage) GetStale(ctx context.Context, url string) (*CacheEntry, io.ReadCloser, error) {
+	return s.lookup(ctx, url, true)
+}
+
+func (s *Storage) lookup(ctx context.Context, url string, stale bool) (*CacheEntry, io.ReadCloser, error) {
+	ctx, span := tracing.Start(ctx, "cache.lookup", tracing.KindInternal)
+	defer span.End()
+
+	entry, reader, err := s.get(ctx, url, stale)
+	span.Set("cascade.cache.hit", err == nil)
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrExpired) {
+		span.Fail(err)
+	}
+	return entry, reader, err
+}
+
+func (s *Storage) get(ctx context.Context, url string, stale bool) (*CacheEntry, io.ReadCloser, error) {
+	key := Key(url)
 	dataPath, metaPath := s.getFilePath(key)
 
-	unlock, err := s.fileLock.Lock(dataPath)
+	unlock, err := s.lock(ctx, dataPath, "get")
 	if err != nil {
 		return nil, nil, err
 	}
@@ -98,13 +187,20 @@ func (s *Storage) Get(url string) (*CacheEntry, io.ReadCloser, error) {
 	entry, err := LoadCacheEntry(metaPath)
 	if err != nil {
 		unlock()
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
 		return nil, nil, err
 	}
 
-	if entry.IsExpired() {
+	if s.tooStale(entry) {
 		unlock()
 		s.Delete(url)
-		return nil, nil, fmt.Errorf("cache entry expired")
+		return nil, nil, ErrExpired
+	}
+	if entry.IsExpired() && !stale {
+		unlock()
+		return nil, nil, ErrExpired
 	}
 
 	file, err := os.Open(dataPath)
@@ -113,9 +209,20 @@ func (s *Storage) Get(url string) (*CacheEntry, io.ReadCloser, error) {
 		return nil, nil, err
 	}
 
+	s.settingsMu.RLock()
+	verifyOnRead := s.verifyOnRead
+	s.settingsMu.RUnlock()
+
+	if err := verifyData(entry, file, s.bufferSize, verifyOnRead); err != nil {
+		file.Close()
+		s.quarantine(key, dataPath, metaPath, err)
+		unlock()
+		return nil, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
 	s.lru.Get(key)
 	entry.AccessedAt = time.Now()
-	entry.Save(metaPath)
+	entry.save(metaPath, false)
 
 	reader := &lockedReader{
 		ReadCloser: file,
@@ -136,34 +243,60 @@ func (lr *lockedReader) Close() error {
 	return err
 }
 
-func (s *Storage) Put(url string, contentType string, headers map[string]string, ttl time.Duration, reader io.Reader, expectedSize int64) error {
-	key := s.generateKey(url)
+// Put streams reader into the cache under url. The object is only committed
+// if it arrives complete and within the configured size limits.
+func (s *Storage) Put(ctx context.Context, url string, contentType string, headers map[string]string, ttl time.Duration, reader io.Reader, expectedSize int64) error {
+	ctx, span := tracing.Start(ctx, "cache.write", tracing.KindInternal)
+	defer span.End()
+
+	err := s.put(ctx, url, contentType, headers, ttl, reader, expectedSize)
+	span.Set("cascade.cache.stored", err == nil)
+	if err != nil && !errors.Is(err, ErrTooSmall) && !errors.Is(err, ErrTooLarge) {
+		span.Fail(err)
+	}
+	return err
+}
+
+func (s *Storage) put(ctx context.Context, url string, contentType string, headers map[string]string, ttl time.Duration, reader io.Reader, expectedSize int64) error {
+	key := Key(url)
 	dataPath, metaPath := s.getFilePath(key)
 
 	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
 		return fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
-	unlock, err := s.fileLock.Lock(dataPath)
+	unlock, err := s.lock(ctx, dataPath, "put")
 	if err != nil {
 		return err
 	}
 	defer unlock()
 
-	tempPath := dataPath + ".tmp"
+	tempPath := dataPath + tempSuffix
 	tempFile, err := os.Create(tempPath)
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer os.Remove(tempPath)
 
+	var dst io.Writer = tempFile
+	h, algo := s.newHash()
+	if h != nil {
+		dst = io.MultiWriter(tempFile, h)
+	}
+
 	buffer := make([]byte, s.bufferSize)
-	written, err := io.CopyBuffer(tempFile, reader, buffer)
+	written, err := io.CopyBuffer(dst, reader, buffer)
+	tracing.SpanFromContext(ctx).Set("cascade.cache.bytes", written)
 	if err != nil {
 		tempFile.Close()
 		return fmt.Errorf("failed to write cache data: %w", err)
 	}
 
+	// Everything from here on is local disk I/O; the copy above is paced by
+	// the upstream download.
+	_, commit := tracing.Start(ctx, "cache.commit", tracing.KindInternal)
+	defer commit.End()
+
 	if err := tempFile.Sync(); err != nil {
 		tempFile.Close()
 		return fmt.Errorf("failed to sync temp file: %w", err)
@@ -174,19 +307,15 @@ func (s *Storage) Put(url string, contentType string, headers map[string]string,
 	}
 
 	if written == 0 {
-		return fmt.Errorf("refusing to cache empty file (0 bytes)")
+		return fmt.Errorf("%w (0 bytes)", ErrEmpty)
 	}
 
 	if expectedSize > 0 && written != expectedSize {
-		return fmt.Errorf("incomplete download: got %d bytes, expected %d bytes", written, expectedSize)
-	}
-
-	if written < s.minFileSize {
-		return fmt.Errorf("file too small to cache: %d bytes (min: %d bytes)", written, s.minFileSize)
+		return fmt.Errorf("%w: got %d bytes, expected %d bytes", ErrIncomplete, written, expectedSize)
 	}
 
-	if written > s.maxFileSize {
-		return fmt.Errorf("file too large to cache: %d bytes (max: %d bytes)", written, s.maxFileSize)
+	if err := s.CheckSize(written); err != nil {
+		return err
 	}
 
 	s.evictIfNeeded(written)
@@ -195,6 +324,11 @@ func (s *Storage) Put(url string, contentType string, headers map[string]string,
 		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
 
+	if err := syncDir(filepath.Dir(dataPath)); err != nil {
+		os.Remove(dataPath)
+		return err
+	}
+
 	entry := &CacheEntry{
 		Key:         key,
 		URL:         url,
@@ -206,6 +340,10 @@ func (s *Storage) Put(url string, contentType string, headers map[string]string,
 		AccessedAt:  time.Now(),
 		ExpiresAt:   time.Now().Add(ttl),
 	}
+	if h != nil {
+		entry.ChecksumAlgorithm = algo
+		entry.Checksum = hex.EncodeToString(h.Sum(nil))
+	}
 
 	if err := entry.Save(metaPath); err != nil {
 		os.Remove(dataPath)
@@ -217,12 +355,74 @@ func (s *Storage) Put(url string, contentType string, headers map[string]string,
 	return nil
 }
 
+// CheckSize returns ErrTooSmall or ErrTooLarge if an object of size bytes is
+// outside the configured limits. A negative size is unknown and passes.
+func (s *Storage) CheckSize(size int64) error {
+	if size < 0 {
+		return nil
+	}
+	s.settingsMu.RLock()
+	minFileSize, maxFileSize := s.minFileSize, s.maxFileSize
+	s.settingsMu.RUnlock()
+
+	if size < minFileSize {
+		return fmt.Errorf("%w: %d bytes (min: %d bytes)", ErrTooSmall, size, minFileSize)
+	}
+	if size > maxFileSize {
+		return fmt.Errorf("%w: %d bytes (max: %d bytes)", ErrTooLarge, size, maxFileSize)
+	}
+	return nil
+}
+
+// SetLimits changes the cache capacity and the object size limits, evicting
+// objects at once if the cache no longer fits.
+func (s *Storage) SetLimits(maxSizeBytes, minFileSizeKB, maxFileSizeMB int64) {
+	s.settingsMu.Lock()
+	s.minFileSize = minFileSizeKB * 1024
+	s.maxFileSize = maxFileSizeMB * 1024 * 1024
+	s.settingsMu.Unlock()
+
+	s.lru.SetCapacity(maxSizeBytes)
+	s.evictIfNeeded(0)
+}
+
+// SetStaleIfError changes how long expired objects are kept for GetStale.
+func (s *Storage) SetStaleIfError(d time.Duration) {
+	s.settingsMu.Lock()
+	s.staleIfError = d
+	s.settingsMu.Unlock()
+}
+
+// tooStale reports whether entry expired longer than the stale-if-error
+// time ago and can be deleted.
+func (s *Storage) tooStale(entry *CacheEntry) bool {
+	s.settingsMu.RLock()
+	staleIfError := s.staleIfError
+	s.settingsMu.RUnlock()
+	return time.Since(entry.ExpiresAt) > staleIfError
+}
+
+// lock takes the object lock for dataPath and records how long it waited.
+func (s *Storage) lock(ctx context.Context, dataPath, op string) (func(), error) {
+	_, span := tracing.Start(ctx, "cache.lock", tracing.KindInternal)
+	span.Set("cascade.lock.op", op)
+	defer span.End()
+
+	start := time.Now()
+	unlock, err := s.fileLock.Lock(dataPath)
+	lockWaitSeconds.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	span.Fail(err)
+	return unlock, err
+}
+
 func (s *Storage) evictIfNeeded(newSize int64) {
 	for s.lru.Size()+newSize > s.lru.Capacity() {
-		key, _, ok := s.lru.GetOldest()
+		key, size, ok := s.lru.GetOldest()
 		if !ok {
 			break
 		}
+		evictionsTotal.Inc()
+		evictedBytesTotal.Add(float64(size))
 
 		_, metaPath := s.getFilePath(key)
 		entry, err := LoadCacheEntry(metaPath)
@@ -234,10 +434,10 @@ func (s *Storage) evictIfNeeded(newSize int64) {
 }
 
 func (s *Storage) Delete(url string) error {
-	key := s.generateKey(url)
+	key := Key(url)
 	dataPath, metaPath := s.getFilePath(key)
 
-	unlock, err := s.fileLock.Lock(dataPath)
+	unlock, err := s.lock(context.Background(), dataPath, "delete")
 	if err != nil {
 		return err
 	}
@@ -252,12 +452,12 @@ func (s *Storage) Delete(url string) error {
 
 func (s *Storage) deleteEntry(entry *CacheEntry) {
 	os.Remove(entry.FilePath)
-	metaPath := strings.TrimSuffix(entry.FilePath, ".data") + ".meta"
+	metaPath := strings.TrimSuffix(entry.FilePath, dataSuffix) + metaSuffix
 	os.Remove(metaPath)
 }
 
 func (s *Storage) GetStats() (int64, int64, int) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.lru.Size(), s.lru.Capacity(), len(s.lru.items)
+	return s.lru.Size(), s.lru.Capacity(), s.lru.Len()
 }
@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Problem kinds reported by Verify.
+const (
+	ProblemOrphanData       = "orphan_data"
+	ProblemOrphanMeta       = "orphan_meta"
+	ProblemBadMeta          = "bad_meta"
+	ProblemSizeMismatch     = "size_mismatch"
+	ProblemChecksumMismatch = "checksum_mismatch"
+	ProblemExpired          = "expired"
+	ProblemTempFile         = "temp_file"
+	ProblemLockFile         = "lock_file"
+	ProblemUnknownFile      = "unknown_file"
+	ProblemOverQuota        = "over_quota"
+)
+
+type VerifyOptions struct {
+	// Checksums re-hashes every data file that has a recorded checksum.
+	Checksums bool
+	// Repair removes, quarantines or evicts whatever is found broken.
+	Repair bool
+}
+
+type Problem struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	URL      string `json:"url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+type VerifyReport struct {
+	Directory  string    `json:"directory"`
+	CheckedAt  time.Time `json:"checked_at"`
+	Entries    int       `json:"entries"`
+	Valid      int       `json:"valid"`
+	Busy       int       `json:"busy"`
+	TotalBytes int64     `json:"total_bytes"`
+	MaxBytes   int64     `json:"max_bytes"`
+	OverQuota  bool      `json:"over_quota"`
+	Problems   []Problem `json:"problems"`
+	// Notices are findings that need no repair, such as expired entries,
+	// which the server refreshes or serves stale on its own.
+	Notices []Problem `json:"notices"`
+}
+
+// Unrepaired returns the number of problems that are still present.
+func (r *VerifyReport) Unrepaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *VerifyReport) add(kind, path, url, detail string, repaired bool) {
+	r.Problems = append(r.Problems, Problem{
+		Kind:     kind,
+		Path:     path,
+		URL:      url,
+		Detail:   detail,
+		Repaired: repaired,
+	})
+}
+
+// Verify walks the cache directory and checks every .meta/.data pair: the
+// metadata must parse and belong to its file name, the data size must match,
+// and the checksum must match when requested. Expired entries are noted but
+// kept. It also reports temp, lock and unknown files and whether the cache exceeds
+// the storage capacity. Keys locked by a running instance are skipped.
+func (s *Storage) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	report := &VerifyReport{
+		Directory: s.baseDir,
+		CheckedAt: time.Now(),
+		MaxBytes:  s.lru.Capacity(),
+		Problems:  []Problem{},
+		Notices:   []Problem{},
+	}
+
+	top, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var live []*CacheEntry
+	for _, d := range top {
+		path := filepath.Join(s.baseDir, d.Name())
+		if d.Name() == quarantineDir && d.IsDir() {
+			continue
+		}
+		if !d.IsDir() || !isShardName(d.Name()) {
+			report.add(ProblemUnknownFile, path, "", "not a cache shard", false)
+			continue
+		}
+
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := make(map[string]*shardFiles)
+		var order []string
+		for _, f := range files {
+			filePath := filepath.Join(path, f.Name())
+			key, kind, ok := splitCacheFileName(f.Name())
+			if !ok || f.IsDir() || !isCacheKey(key) || key[:2] != d.Name() {
+				report.add(ProblemUnknownFile, filePath, "", "", opts.Repair && !f.IsDir() && removeOK(filePath))
+				continue
+			}
+
+			sf, exists := keys[key]
+			if !exists {
+				sf = &shardFiles{}
+				keys[key] = sf
+				order = append(order, key)
+			}
+			switch kind {
+			case dataSuffix:
+				sf.data = true
+			case metaSuffix:
+				sf.meta = true
+			case dataSuffix + tempSuffix:
+				sf.dataTemp = true
+			case metaSuffix + tempSuffix:
+				sf.metaTemp = true
+			case dataSuffix + lockSuffix:
+				sf.lock = true
+			default:
+				report.add(ProblemUnknownFile, filePath, "", "", opts.Repair && removeOK(filePath))
+			}
+		}
+
+		for _, key := range order {
+			entry, err := s.verifyKey(key, keys[key], opts, report)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				live = append(live, entry)
+			}
+		}
+	}
+
+	report.OverQuota = report.MaxBytes > 0 && report.TotalBytes > report.MaxBytes
+	if report.OverQuota {
+		detail := fmt.Sprintf("%d bytes cached, capacity %d bytes", report.TotalBytes, report.MaxBytes)
+		repaired := false
+		if opts.Repair {
+			repaired = s.evictOffline(live, report)
+		}
+		report.add(ProblemOverQuota, s.baseDir, "", detail, repaired)
+	}
+
+	return report, nil
+}
+
+func (s *Storage) verifyKey(key string, sf *shardFiles, opts VerifyOptions, report *VerifyReport) (*CacheEntry, error) {
+	dataPath, metaPath := s.getFilePath(key)
+
+	unlock, ok, err := s.fileLock.TryLock(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		report.Busy++
+		return nil, nil
+	}
+	defer unlock()
+
+	if sf.dataTemp {
+		report.add(ProblemTempFile, dataPath+tempSuffix, "", "", opts.Repair && removeOK(dataPath+tempSuffix))
+	}
+	if sf.metaTemp {
+		report.add(ProblemTempFile, metaPath+tempSuffix, "", "", opts.Repair && removeOK(metaPath+tempSuffix))
+	}
+	if sf.lock {
+		// Holding the lock proves the file is stale, and unlock removes it
+		// whether or not a repair was requested.
+		report.add(ProblemLockFile, dataPath+lockSuffix, "", "stale", true)
+	}
+
+	if !sf.meta && !sf.data {
+		return nil, nil
+	}
+
+	report.Entries++
+
+	if !sf.meta {
+		report.add(ProblemOrphanData, dataPath, "", "no metadata", opts.Repair && removeOK(dataPath))
+		return nil, nil
+	}
+	if !sf.data {
+		report.add(ProblemOrphanMeta, metaPath, "", "no data file", opts.Repair && removeOK(metaPath))
+		return nil, nil
+	}
+
+	entry, err := LoadCacheEntry(metaPath)
+	if err == nil && entry.Key != key {
+		err = fmt.Errorf("metadata key %q does not match file name", entry.Key)
+	}
+	if err != nil {
+		repaired := opts.Repair && removeOK(metaPath) && removeOK(dataPath)
+		report.add(ProblemBadMeta, metaPath, "", err.Error(), repaired)
+		return nil, nil
+	}
+
+	file, err := os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	verr := verifyData(entry, file, s.bufferSize, opts.Checksums)
+	file.Close()
+
+	if verr != nil {
+		kind := ProblemChecksumMismatch
+		if info, err := os.Stat(dataPath); err == nil && info.Size() != entry.Size {
+			kind = ProblemSizeMismatch
+		}
+		if opts.Repair {
+			s.quarantine(key, dataPath, metaPath, verr)
+		}
+		report.add(kind, dataPath, entry.URL, verr.Error(), opts.Repair)
+		return nil, nil
+	}
+
+	if entry.IsExpired() {
+		detail := fmt.Sprintf("expired %s", entry.ExpiresAt.Format(time.RFC3339))
+		report.Notices = append(report.Notices, Problem{Kind: ProblemExpired, Path: metaPath, URL: entry.URL, Detail: detail})
+	}
+
+	report.Valid++
+	report.TotalBytes += entry.Size
+	return entry, nil
+}
+
+// evictOffline removes the least recently accessed entries until the cache
+// fits its capacity again.
+func (s *Storage) evictOffline(entries []*CacheEntry, report *VerifyReport) bool {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].AccessedAt.Before(entries[j].AccessedAt)
+	})
+
+	for _, entry := range entries {
+		if report.TotalBytes <= report.MaxBytes {
+			break
+		}
+
+		dataPath, metaPath := s.getFilePath(entry.Key)
+		unlock, ok, err := s.fileLock.TryLock(dataPath)
+		if err != nil || !ok {
+			continue
+		}
+		removed := removeOK(dataPath) && removeOK(metaPath)
+		unlock()
+		if !removed {
+			continue
+		}
+
+		report.TotalBytes -= entry.Size
+	}
+
+	return report.TotalBytes <= report.MaxBytes
+}
+
+func removeOK(path string) bool {
+	err := os.Remove(path)
+	return err == nil || os.IsNotExist(err)
+}
+
+func isCacheKey(key string) bool {
+	if len(key) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
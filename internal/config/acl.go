@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL actions.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLRule allows or denies requests from clients to destinations. All
+// non-empty criteria must hold; the first matching rule decides.
+type ACLRule struct {
+	Name   string `yaml:"name,omitempty"`
+	Action string `yaml:"action"`
+	// Clients are client addresses or CIDR ranges.
+	Clients StringList `yaml:"clients,omitempty"`
+	// Hosts are destination host globs.
+	Hosts   StringList `yaml:"hosts,omitempty"`
+	Ports   []int      `yaml:"ports,omitempty"`
+	Methods StringList `yaml:"methods,omitempty"`
+	// Users are authenticated user names; "*" matches any user, but not
+	// anonymous requests.
+	Users StringList `yaml:"users,omitempty"`
+}
+
+// DefaultConnectPorts are the ports CONNECT may reach unless
+// server.connect_ports says otherwise.
+var DefaultConnectPorts = []int{443}
+
+// ParseNetwork parses a client address or CIDR range. A single address is a
+// range of one.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (r ACLRule) validate(v *validator, path string) {
+	if r.Action != ACLAllow && r.Action != ACLDeny {
+		v.errorf(path+".action", "must be allow or deny, got %q", r.Action)
+	}
+	for i, client := range r.Clients {
+		if _, err := ParseNetwork(client); err != nil {
+			v.errorf(fmt.Sprintf("%s.clients[%d]", path, i), "%q is not an address or CIDR range", client)
+		}
+	}
+	checkHostPatterns(v, path+".hosts", r.Hosts)
+	for i, port := range r.Ports {
+		if !validPort(port) {
+			v.errorf(fmt.Sprintf("%s.ports[%d]", path, i), "must be between 1 and 65535, got %d", port)
+		}
+	}
+	for i, method := range r.Methods {
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			v.errorf(fmt.Sprintf("%s.methods[%d]", path, i), "invalid method %q", method)
+		}
+	}
+}
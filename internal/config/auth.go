@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// AuthConfig configures proxy authentication through Proxy-Authorization.
+// It is enabled once any backend is configured.
+type AuthConfig struct {
+	// Realm is sent in the Proxy-Authenticate challenge.
+	Realm string `yaml:"realm"`
+	// Optional serves requests without credentials as anonymous instead of
+	// challenging them, leaving it to the ACL to require a user.
+	Optional bool `yaml:"optional"`
+	// Users maps user names to plain-text passwords for Basic
+	// authentication.
+	Users map[string]string `yaml:"users"`
+	// Htpasswd is an htpasswd file with bcrypt hashes, checked after Users
+	// and re-read when it changes.
+	Htpasswd string `yaml:"htpasswd"`
+	// Tokens maps user names to bearer tokens.
+	Tokens map[string]string `yaml:"tokens"`
+}
+
+// Enabled reports whether any authentication backend is configured.
+func (a AuthConfig) Enabled() bool {
+	return len(a.Users) > 0 || a.Htpasswd != "" || len(a.Tokens) > 0
+}
+
+func (a AuthConfig) validate(v *validator) {
+	if !a.Enabled() {
+		if a.Optional {
+			v.warnf("auth.optional", "has no effect without users, htpasswd or tokens")
+		}
+		return
+	}
+
+	for _, user := range sortedKeys(a.Users) {
+		path := "auth.users" + mapKey(user)
+		if user == "" || strings.Contains(user, ":") {
+			v.errorf(path, "user names must be non-empty and must not contain \":\"")
+		}
+		if a.Users[user] == "" {
+			v.errorf(path, "empty password")
+		}
+	}
+	if a.Htpasswd != "" {
+		if _, err := os.Stat(a.Htpasswd); err != nil {
+			v.errorf("auth.htpasswd", "%v", err)
+		}
+	}
+	owners := make(map[string]string)
+	for _, user := range sortedKeys(a.Tokens) {
+		path := "auth.tokens" + mapKey(user)
+		token := a.Tokens[user]
+		if token == "" {
+			v.errorf(path, "empty token")
+		} else if other, ok := owners[token]; ok {
+			v.errorf(path, "same token as %s", other)
+		}
+		owners[token] = user
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkACLUsers warns about ACL rules that match on users while nobody can
+// authenticate.
+func (c *Config) checkACLUsers(v *validator) {
+	if c.Auth.Enabled() {
+		return
+	}
+	for i, rule := range c.ACL {
+		if len(rule.Users) > 0 {
+			v.warnf(fmt.Sprintf("acl[%d].users", i), "never matches: auth is not configured")
+		}
+	}
+}
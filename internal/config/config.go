@@ -1,24 +1,114 @@
 package config
 
 import (
-	"fmt"
-	"os"
-	"strings"
+	"net/url"
+	"reflect"
 	"time"
-
-	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Server ServerConfig `yaml:"server"`
 	Cache  CacheConfig  `yaml:"cache"`
 	Egress EgressConfig `yaml:"egress"`
-	Rules  RulesConfig  `yaml:"rules"`
+	// Destinations is enforced when dialing upstream, for cache fills,
+	// forwarded requests and CONNECT tunnels alike.
+	Destinations DestinationsConfig `yaml:"destinations"`
+	Upstreams    UpstreamsConfig    `yaml:"upstreams"`
+	Mirrors      []MirrorPool       `yaml:"mirrors"`
+	Rules        RulesConfig        `yaml:"rules"`
+	Profiles     ProfilesConfig     `yaml:"profiles"`
+	Auth         AuthConfig         `yaml:"auth"`
+	ACL          []ACLRule          `yaml:"acl"`
+	Limits       LimitsConfig       `yaml:"limits"`
+	Admin        AdminConfig        `yaml:"admin"`
+	Metrics      MetricsConfig      `yaml:"metrics"`
+	AccessLog    AccessLogConfig    `yaml:"access_log"`
+	Log          LogConfig          `yaml:"log"`
+	Tracing      TracingConfig      `yaml:"tracing"`
+
+	warnings []Problem
+	files    []string
+}
+
+// Warnings returns problems found by Load that do not stop Cascade from
+// starting, such as settings that have no effect.
+func (c *Config) Warnings() []Problem {
+	return c.warnings
+}
+
+// Files returns the configuration files Load read, in the order they were
+// merged.
+func (c *Config) Files() []string {
+	return c.files
+}
+
+// TracingConfig configures OpenTelemetry trace export over OTLP/HTTP.
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the collector's OTLP/HTTP traces URL.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with every export, e.g. for collector authentication.
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	// SampleRatio is the fraction of new traces recorded. Requests with a
+	// sampled traceparent are always recorded. Zero means 1.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// LogConfig configures the diagnostic log written to stderr.
+type LogConfig struct {
+	// Level is debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format"`
+	// Debug lists subsystems (main, proxy, cache, admin, tracing) that log at debug
+	// level whatever the global level is.
+	Debug []string `yaml:"debug"`
+}
+
+// AccessLogConfig configures the per-request access log, which is separate
+// from the diagnostic log.
+type AccessLogConfig struct {
+	// Path of the log file; "-" writes to stdout and empty disables it.
+	Path string `yaml:"path"`
+	// Format is squid, combined or json.
+	Format string `yaml:"format"`
+}
+
+// MetricsConfig controls the Prometheus metrics served on the admin listener.
+type MetricsConfig struct {
+	// HostGroups collapse origin hosts into a bounded set of host_group
+	// label values; hosts matching no group are labelled "other".
+	HostGroups []HostGroupConfig `yaml:"host_groups"`
+}
+
+type HostGroupConfig struct {
+	Name  string   `yaml:"name"`
+	Hosts []string `yaml:"hosts"`
 }
 
 type ServerConfig struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
+	// DebugHeaders adds X-Cascade-Key, X-Cascade-Rule and X-Cascade-TTL to
+	// responses.
+	DebugHeaders bool `yaml:"debug_headers"`
+	// ConnectPorts are the ports CONNECT tunnels may reach; nil means 443
+	// only.
+	ConnectPorts []int `yaml:"connect_ports"`
+}
+
+// AdminConfig configures the admin API listener, which is separate from the
+// proxy port.
+type AdminConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Host    string `yaml:"host"`
+	Port    int    `yaml:"port"`
+	// Token, if set, must be presented as "Authorization: Bearer <token>".
+	Token string `yaml:"token"`
+	// Username and Password, if set, enable HTTP Basic authentication.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 type CacheConfig struct {
@@ -29,6 +119,21 @@ type CacheConfig struct {
 	DefaultTTL     time.Duration `yaml:"default_ttl"`
 	BufferSizeKB   int           `yaml:"buffer_size_kb"`
 	RespectHeaders bool          `yaml:"respect_headers"`
+	// ScavengeInterval controls how often orphaned, temp and stale lock
+	// files are swept from the cache directory. A negative value disables
+	// the background sweep; one pass always runs at startup.
+	ScavengeInterval time.Duration `yaml:"scavenge_interval"`
+	// Checksum is the digest recorded for every cached object: sha256,
+	// sha512 or none.
+	Checksum     string `yaml:"checksum"`
+	VerifyOnRead bool   `yaml:"verify_on_read"`
+	// ScrubInterval controls how often the background scrubber re-hashes
+	// every cached object. A negative value disables the scrubber.
+	ScrubInterval time.Duration `yaml:"scrub_interval"`
+	// StaleIfError keeps expired objects for this long, to be served while
+	// their origin is failing or its circuit breaker is open. Zero deletes
+	// objects as soon as they expire.
+	StaleIfError time.Duration `yaml:"stale_if_error"`
 }
 
 type EgressConfig struct {
@@ -37,21 +142,24 @@ type EgressConfig struct {
 	ProxyURL  string `yaml:"proxy_url"`
 }
 
-type RulesConfig struct {
-	Passthrough      []string          `yaml:"passthrough"`
-	HTTPSPassthrough []string          `yaml:"https_passthrough"`
-	SpecialTTL       map[string]string `yaml:"special_ttl"`
-}
-
-func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+// Load reads the configuration file at path, applies the overrides on top
+// and fills in defaults. An empty path means there is no file.
+func Load(path string, overrides ...Override) (*Config, error) {
+	v := newValidator()
+	if path != "" {
+		if err := v.readConfig(path); err != nil {
+			return nil, err
+		}
 	}
+	v.applyOverrides(v.root, overrides)
+	v.checkFields(v.root, reflect.TypeOf(Config{}), "")
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	if v.root.Kind != 0 {
+		// Each file has been checked on its own already.
+		if err := v.root.Decode(&cfg); err != nil && len(v.errors) == 0 {
+			v.decodeError("", err)
+		}
 	}
 
 	if cfg.Server.Host == "" {
@@ -60,10 +168,34 @@ func Load(path string) (*Config, error) {
 	if cfg.Server.Port == 0 {
 		cfg.Server.Port = 3142
 	}
+	if cfg.Admin.Host == "" {
+		cfg.Admin.Host = "127.0.0.1"
+	}
+	if cfg.Admin.Port == 0 {
+		cfg.Admin.Port = 3143
+	}
+	if cfg.AccessLog.Format == "" {
+		cfg.AccessLog.Format = "squid"
+	}
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = "info"
+	}
+	if cfg.Log.Format == "" {
+		cfg.Log.Format = "text"
+	}
+	if cfg.Tracing.Endpoint == "" {
+		cfg.Tracing.Endpoint = "http://localhost:4318/v1/traces"
+	}
+	if cfg.Tracing.ServiceName == "" {
+		cfg.Tracing.ServiceName = "cascade"
+	}
+	if cfg.Tracing.SampleRatio == 0 {
+		cfg.Tracing.SampleRatio = 1
+	}
 	if cfg.Cache.Directory == "" {
 		cfg.Cache.Directory = "/var/cache/cascade"
 	}
-	if cfg.Cache.MaxSizeGB <= 0 {
+	if cfg.Cache.MaxSizeGB == 0 {
 		cfg.Cache.MaxSizeGB = 100
 	}
 	if cfg.Cache.MinFileSizeKB == 0 {
@@ -78,44 +210,78 @@ func Load(path string) (*Config, error) {
 	if cfg.Cache.BufferSizeKB == 0 {
 		cfg.Cache.BufferSizeKB = 64
 	}
-
-	for pattern := range cfg.Rules.SpecialTTL {
-		ttlStr := cfg.Rules.SpecialTTL[pattern]
-		_, err := time.ParseDuration(ttlStr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid TTL for pattern %s: %w", pattern, err)
+	if cfg.Cache.ScavengeInterval == 0 {
+		cfg.Cache.ScavengeInterval = time.Hour
+	}
+	if cfg.Cache.ScrubInterval == 0 {
+		cfg.Cache.ScrubInterval = 24 * time.Hour
+	}
+	if cfg.Auth.Realm == "" {
+		cfg.Auth.Realm = "cascade"
+	}
+	if cfg.Limits.Key == "" {
+		cfg.Limits.Key = LimitKeyIP
+	}
+	cfg.Limits.Hit.setDefaults()
+	cfg.Limits.Miss.setDefaults()
+	cfg.Upstreams.setDefaults()
+	for i := range cfg.Mirrors {
+		if cfg.Mirrors[i].Select == "" {
+			cfg.Mirrors[i].Select = MirrorSelectLatency
 		}
 	}
+	if cfg.Server.ConnectPorts == nil {
+		cfg.Server.ConnectPorts = DefaultConnectPorts
+	}
+	if cfg.Cache.Checksum == "" {
+		cfg.Cache.Checksum = "sha256"
+	}
+
+	cfg.validate(v)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	sortProblems(v.warnings)
+	cfg.warnings = v.warnings
+	cfg.files = v.read
 
 	return &cfg, nil
 }
 
-func (c *Config) GetTTLForPath(path string) time.Duration {
-	for pattern, ttlStr := range c.Rules.SpecialTTL {
-		if matchPattern(path, pattern) {
-			ttl, _ := time.ParseDuration(ttlStr)
-			return ttl
-		}
-	}
-	return c.Cache.DefaultTTL
-}
+const redacted = "REDACTED"
 
-func matchPattern(path, pattern string) bool {
-	if pattern == "*" {
-		return true
-	}
+// Redacted returns a copy of the configuration with secrets replaced, suitable
+// for display.
+func (c *Config) Redacted() *Config {
+	r := *c
 
-	if strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*") {
-		return strings.Contains(path, pattern[1:len(pattern)-1])
+	if r.Admin.Token != "" {
+		r.Admin.Token = redacted
 	}
-
-	if strings.HasPrefix(pattern, "*") {
-		return strings.HasSuffix(path, pattern[1:])
+	if r.Admin.Password != "" {
+		r.Admin.Password = redacted
 	}
-
-	if strings.HasSuffix(pattern, "*") {
-		return strings.HasPrefix(path, pattern[:len(pattern)-1])
+	r.Auth.Users = redactValues(r.Auth.Users)
+	r.Auth.Tokens = redactValues(r.Auth.Tokens)
+	r.Tracing.Headers = redactValues(r.Tracing.Headers)
+	if u, err := url.Parse(r.Egress.ProxyURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			r.Egress.ProxyURL = u.String()
+		}
 	}
 
-	return strings.Contains(path, pattern)
+	return &r
+}
+
+// redactValues returns a copy of m with every value replaced.
+func redactValues(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return m
+	}
+	r := make(map[string]string, len(m))
+	for k := range m {
+		r[k] = redacted
+	}
+	return r
 }
@@ -0,0 +1,35 @@
+package config
+
+import "fmt"
+
+// DestinationsConfig limits the addresses Cascade connects to upstream.
+// Loopback, private, link-local (including cloud metadata services) and
+// other special-purpose ranges are blocked unless listed in Allow.
+type DestinationsConfig struct {
+	// Allow lists addresses or CIDR ranges to reach despite the default
+	// blocks.
+	Allow StringList `yaml:"allow"`
+	// Deny lists further addresses or CIDR ranges to block; it wins over
+	// Allow.
+	Deny StringList `yaml:"deny"`
+	// ResolveViaEgress lets names that do not resolve locally through to the
+	// egress proxy, which resolves them unchecked. By default they are
+	// refused.
+	ResolveViaEgress bool `yaml:"resolve_via_egress"`
+}
+
+func (d DestinationsConfig) validate(v *validator, egress bool) {
+	for i, s := range d.Allow {
+		if _, err := ParseNetwork(s); err != nil {
+			v.errorf(fmt.Sprintf("destinations.allow[%d]", i), "%q is not an address or CIDR range", s)
+		}
+	}
+	for i, s := range d.Deny {
+		if _, err := ParseNetwork(s); err != nil {
+			v.errorf(fmt.Sprintf("destinations.deny[%d]", i), "%q is not an address or CIDR range", s)
+		}
+	}
+	if d.ResolveViaEgress && !egress {
+		v.warnf("destinations.resolve_via_egress", "has no effect without an egress proxy")
+	}
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DropInDir is the directory next to the configuration file whose *.yaml
+// files are merged into it, in name order, after its includes.
+const DropInDir = "conf.d"
+
+// includeKey lists further files to merge, as paths or globs relative to the
+// file that names them.
+const includeKey = "include"
+
+// readConfig reads the configuration file at path, then every file it
+// includes, then the drop-in directory, merging each into the result.
+func (v *validator) readConfig(path string) error {
+	seen := make(map[string]bool)
+	root, err := v.readFile(path, path, seen)
+	if err != nil {
+		return err
+	}
+
+	dropIns, _ := filepath.Glob(filepath.Join(filepath.Dir(path), DropInDir, "*.yaml"))
+	for _, file := range dropIns {
+		if err := v.include(root, path, file, seen); err != nil {
+			return err
+		}
+	}
+
+	v.root = root
+	return nil
+}
+
+// readFile parses one file and merges in the files it includes. main is the
+// top-level configuration file; nodes from other files are recorded in
+// v.files so problems name the file they are in.
+func (v *validator) readFile(main, path string, seen map[string]bool) (*yaml.Node, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		seen[abs] = true
+	}
+	v.read = append(v.read, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	file := ""
+	if path != main {
+		file = path
+		v.markFile(&doc, file)
+	}
+
+	patterns, err := takeIncludes(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Check the types in each file on its own, so errors name the right
+	// file; the merged result is only decoded once.
+	var cfg Config
+	if err := doc.Decode(&cfg); err != nil {
+		v.decodeError(file, err)
+	}
+
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %q: %w", path, pattern, err)
+		}
+		if len(matches) == 0 && !hasGlobMeta(pattern) {
+			return nil, fmt.Errorf("%s: include %q: no such file", path, pattern)
+		}
+		for _, match := range matches {
+			if err := v.include(&doc, main, match, seen); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &doc, nil
+}
+
+// include merges the file at path into root unless it has been read
+// already, which also stops include loops.
+func (v *validator) include(root *yaml.Node, main, path string, seen map[string]bool) error {
+	if abs, err := filepath.Abs(path); err == nil && seen[abs] {
+		return nil
+	}
+	doc, err := v.readFile(main, path, seen)
+	if err != nil {
+		return err
+	}
+	mergeNode(root.Content[0], doc.Content[0])
+	return nil
+}
+
+// takeIncludes removes the include setting from the document and returns
+// its patterns.
+func takeIncludes(doc *yaml.Node) ([]string, error) {
+	top := doc.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		if top.Content[i].Value != includeKey {
+			continue
+		}
+		var patterns StringList
+		if err := top.Content[i+1].Decode(&patterns); err != nil {
+			return nil, fmt.Errorf("line %d: include: want a path or a list of paths", top.Content[i].Line)
+		}
+		top.Content = append(top.Content[:i], top.Content[i+2:]...)
+		return patterns, nil
+	}
+	return nil, nil
+}
+
+// mergeNode merges src into dst: mappings merge key by key, lists append,
+// and anything else, including a value of a different kind, replaces dst.
+func mergeNode(dst, src *yaml.Node) {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+			merged := false
+			for j := 0; j+1 < len(dst.Content); j += 2 {
+				if dst.Content[j].Value != key.Value {
+					continue
+				}
+				if old := dst.Content[j+1]; old.Kind == value.Kind && old.Kind != yaml.ScalarNode {
+					mergeNode(old, value)
+				} else {
+					// Take the key too, so problems point at the
+					// file the value came from.
+					dst.Content[j], dst.Content[j+1] = key, value
+				}
+				merged = true
+				break
+			}
+			if !merged {
+				dst.Content = append(dst.Content, key, value)
+			}
+		}
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		dst.Content = append(dst.Content, src.Content...)
+	default:
+		*dst = *src
+	}
+}
+
+func (v *validator) markFile(n *yaml.Node, file string) {
+	v.files[n] = file
+	for _, c := range n.Content {
+		v.markFile(c, file)
+	}
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
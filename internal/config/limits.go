@@ -0,0 +1,70 @@
+package config
+
+import "math"
+
+// Keys that per-client limits are counted against.
+const (
+	LimitKeyIP   = "ip"
+	LimitKeyUser = "user"
+)
+
+// LimitsConfig throttles clients and upstream traffic with token buckets. A
+// rate of zero means no limit.
+type LimitsConfig struct {
+	// Key is what per-client limits count against: ip, or user for the
+	// authenticated user, falling back to the client IP for anonymous
+	// requests.
+	Key string `yaml:"key"`
+	// Hit limits responses served from the cache.
+	Hit ClientLimits `yaml:"hit"`
+	// Miss limits responses fetched from upstream, forwarded requests and
+	// CONNECT tunnels.
+	Miss ClientLimits `yaml:"miss"`
+	// UpstreamBytesPerSecond caps the bandwidth of all upstream traffic
+	// together.
+	UpstreamBytesPerSecond ByteSize `yaml:"upstream_bytes_per_second"`
+}
+
+// ClientLimits are the limits for each client.
+type ClientLimits struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is how many requests a client may make at once before
+	// RequestsPerSecond applies; zero means RequestsPerSecond rounded up.
+	Burst          int      `yaml:"burst"`
+	BytesPerSecond ByteSize `yaml:"bytes_per_second"`
+}
+
+func (l *ClientLimits) setDefaults() {
+	if l.Burst == 0 && l.RequestsPerSecond > 0 {
+		l.Burst = int(math.Ceil(l.RequestsPerSecond))
+	}
+}
+
+func (l ClientLimits) validate(v *validator, path string) {
+	if l.RequestsPerSecond < 0 {
+		v.errorf(path+".requests_per_second", "must not be negative")
+	}
+	if l.Burst < 0 {
+		v.errorf(path+".burst", "must not be negative")
+	}
+	if l.BytesPerSecond < 0 {
+		v.errorf(path+".bytes_per_second", "must not be negative")
+	}
+}
+
+func (l LimitsConfig) validate(v *validator, authEnabled bool) {
+	switch l.Key {
+	case LimitKeyIP:
+	case LimitKeyUser:
+		if !authEnabled {
+			v.warnf("limits.key", "auth is not configured, so limits apply per client IP")
+		}
+	default:
+		v.errorf("limits.key", "must be %s or %s, got %q", LimitKeyIP, LimitKeyUser, l.Key)
+	}
+	l.Hit.validate(v, "limits.hit")
+	l.Miss.validate(v, "limits.miss")
+	if l.UpstreamBytesPerSecond < 0 {
+		v.errorf("limits.upstream_bytes_per_second", "must not be negative")
+	}
+}
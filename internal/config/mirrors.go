@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Mirror selection strategies.
+const (
+	MirrorSelectLatency = "latency"
+	MirrorSelectOrder   = "order"
+)
+
+// MirrorScheme starts the cache key of objects fetched through a mirror
+// pool: mirror://<name>/<path>.
+const MirrorScheme = "mirror"
+
+var mirrorNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+// MirrorPool is a logical mirror backed by several upstream base URLs that
+// serve the same tree. Requests under any of the URLs, or to
+// http://<name>/, are cached under one key and fetched from whichever mirror
+// is healthy and fastest.
+type MirrorPool struct {
+	Name string     `yaml:"name"`
+	URLs StringList `yaml:"urls"`
+	// Select is latency, to prefer the mirror answering fastest, or order,
+	// to prefer mirrors in the order listed. Mirrors that failed recently
+	// are tried last either way.
+	Select string `yaml:"select"`
+}
+
+func (p MirrorPool) validate(v *validator, path string, seen map[string]string) {
+	if !mirrorNamePattern.MatchString(p.Name) {
+		v.errorf(path+".name", "must be a lower-case host name, got %q", p.Name)
+	} else if other, ok := seen[p.Name]; ok {
+		v.errorf(path+".name", "%q is already used by %s", p.Name, other)
+	} else {
+		seen[p.Name] = path
+	}
+
+	if len(p.URLs) == 0 {
+		v.errorf(path+".urls", "must list at least one URL")
+	}
+	for i, raw := range p.URLs {
+		urlPath := fmt.Sprintf("%s.urls[%d]", path, i)
+		v.checkURL(urlPath, raw, "http", "https")
+		if u, err := url.Parse(raw); err == nil && (u.RawQuery != "" || u.Fragment != "") {
+			v.errorf(urlPath, "must not have a query or fragment")
+		}
+		base := strings.TrimSuffix(raw, "/")
+		if other, ok := seen[base]; ok {
+			v.errorf(urlPath, "%s is already listed in %s", base, other)
+		} else {
+			seen[base] = urlPath
+		}
+	}
+
+	if p.Select != MirrorSelectLatency && p.Select != MirrorSelectOrder {
+		v.errorf(path+".select", "must be %s or %s, got %q", MirrorSelectLatency, MirrorSelectOrder, p.Select)
+	}
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of every environment variable that sets a
+// configuration setting.
+const EnvPrefix = "CASCADE_"
+
+// envReserved are CASCADE_ variables that are not settings.
+var envReserved = map[string]bool{
+	EnvPrefix + "CONFIG": true,
+}
+
+// Override sets one setting from outside the configuration file. Load applies
+// overrides in order, so a later one wins.
+type Override struct {
+	// Source names where the value came from, e.g. CASCADE_SERVER_PORT or
+	// -server.port; problems with the value are reported against it.
+	Source string
+	Path   string
+	Value  string
+}
+
+// Setting is one configuration setting that can be overridden.
+type Setting struct {
+	Path string
+	Env  string
+	// Type describes the accepted values: string, int, float, bool,
+	// duration, list (comma-separated or YAML) or yaml.
+	Type string
+	typ  reflect.Type
+}
+
+// Settings returns every setting that can be overridden, in file order.
+// Sections are walked down to their fields; lists, maps and rules are set
+// whole.
+func Settings() []Setting {
+	return appendSettings(nil, reflect.TypeOf(Config{}), "")
+}
+
+func appendSettings(settings []Setting, t reflect.Type, path string) []Setting {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || name == "-" || name == "" {
+			continue
+		}
+		fieldPath := joinPath(path, name)
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType && !reflect.PtrTo(f.Type).Implements(unmarshalerTyp) {
+			settings = appendSettings(settings, f.Type, fieldPath)
+			continue
+		}
+		settings = append(settings, Setting{
+			Path: fieldPath,
+			Env:  EnvName(fieldPath),
+			Type: settingType(f.Type),
+			typ:  f.Type,
+		})
+	}
+	return settings
+}
+
+func settingType(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "duration"
+	case t == reflect.TypeOf(ByteSize(0)):
+		return "size"
+	case isStringList(t):
+		return "list"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	}
+	return "yaml"
+}
+
+func isStringList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String
+}
+
+// EnvName returns the environment variable for the setting at path, e.g.
+// CASCADE_CACHE_DEFAULT_TTL for cache.default_ttl.
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// EnvOverrides returns an override for every CASCADE_ variable in environ, a
+// list of KEY=value pairs as returned by os.Environ. NAME_FILE reads the
+// value of NAME from a file, for secrets mounted into a container; a
+// trailing newline is dropped. Variables that name no setting are returned
+// with an empty Path, and Load warns about them.
+func EnvOverrides(environ []string) ([]Override, error) {
+	byEnv := make(map[string]string)
+	for _, s := range Settings() {
+		byEnv[s.Env] = s.Path
+	}
+
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, EnvPrefix) && !envReserved[key] {
+			vars[key] = value
+		}
+	}
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var overrides []Override
+	for _, key := range keys {
+		value := vars[key]
+		if path, ok := byEnv[key]; ok {
+			if _, ok := vars[key+"_FILE"]; ok {
+				return nil, fmt.Errorf("%s and %s_FILE are both set", key, key)
+			}
+			overrides = append(overrides, Override{Source: key, Path: path, Value: value})
+			continue
+		}
+		if name, ok := strings.CutSuffix(key, "_FILE"); ok {
+			if path, ok := byEnv[name]; ok {
+				data, err := os.ReadFile(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+				value = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+				overrides = append(overrides, Override{Source: key, Path: path, Value: value})
+				continue
+			}
+		}
+		overrides = append(overrides, Override{Source: key, Value: value})
+	}
+	return overrides, nil
+}
+
+// applyOverrides sets each override in the parsed file, recording where the
+// values came from so problems with them name the variable or flag.
+func (v *validator) applyOverrides(root *yaml.Node, overrides []Override) {
+	settings := make(map[string]Setting)
+	for _, s := range Settings() {
+		settings[s.Path] = s
+	}
+
+	for _, o := range overrides {
+		s, ok := settings[o.Path]
+		if !ok {
+			v.warnings = append(v.warnings, Problem{Source: o.Source, Path: o.Path, Message: "unknown setting, ignored"})
+			continue
+		}
+		value, err := overrideNode(s.typ, o.Value)
+		if err == nil {
+			err = value.Decode(reflect.New(s.typ).Interface())
+		}
+		if err != nil {
+			v.errors = append(v.errors, Problem{Source: o.Source, Path: o.Path, Message: decodeMessage(err)})
+			continue
+		}
+		clearLines(value)
+		setNode(root, strings.Split(o.Path, "."), value)
+		v.sources[o.Path] = o.Source
+	}
+}
+
+// overrideNode parses an override value for a setting of type t. Strings are
+// taken literally, lists may also be comma-separated and anything else is
+// parsed as YAML.
+func overrideNode(t reflect.Type, raw string) (*yaml.Node, error) {
+	if t.Kind() == reflect.String {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: raw}, nil
+	}
+	if isStringList(t) && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+			}
+		}
+		return seq, nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}, nil
+	}
+	return doc.Content[0], nil
+}
+
+// decodeMessage returns the first message of a YAML error without its line
+// number, which refers to the override value rather than the file.
+func decodeMessage(err error) string {
+	msg := err.Error()
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		msg = typeErr.Errors[0]
+	}
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	var line int
+	if n, _ := fmt.Sscanf(msg, "line %d:", &line); n == 1 {
+		_, msg, _ = strings.Cut(msg, ": ")
+	}
+	return msg
+}
+
+func clearLines(n *yaml.Node) {
+	n.Line, n.Column = 0, 0
+	for _, c := range n.Content {
+		clearLines(c)
+	}
+}
+
+// setNode sets the value at the mapping keys in path, creating mappings on
+// the way and replacing anything else that is in the way.
+func setNode(root *yaml.Node, path []string, value *yaml.Node) {
+	if root.Kind != yaml.DocumentNode {
+		*root = yaml.Node{Kind: yaml.DocumentNode}
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		root.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+
+	node := root.Content[0]
+	for i, key := range path {
+		var next *yaml.Node
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if node.Content[j].Value == key {
+				next = node.Content[j+1]
+				if i == len(path)-1 {
+					node.Content[j+1] = value
+					return
+				}
+				break
+			}
+		}
+		if i == len(path)-1 {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+			return
+		}
+		if next == nil {
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, next)
+		} else if next.Kind != yaml.MappingNode {
+			*next = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		node = next
+	}
+}
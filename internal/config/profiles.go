@@ -0,0 +1,226 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ProfilesConfig enables, disables and overrides repository profiles by
+// name. Names that are not built in define new profiles.
+type ProfilesConfig map[string]ProfileConfig
+
+// ProfileConfig overrides a profile. Unset fields keep the built-in values;
+// a path list replaces the built-in list.
+type ProfileConfig struct {
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Hosts restricts the profile to matching hosts.
+	Hosts     StringList   `yaml:"hosts,omitempty"`
+	Metadata  ProfileGroup `yaml:"metadata,omitempty"`
+	Artifacts ProfileGroup `yaml:"artifacts,omitempty"`
+}
+
+// ProfileGroup is a set of URL path globs sharing a TTL.
+type ProfileGroup struct {
+	Paths StringList    `yaml:"paths,omitempty"`
+	TTL   time.Duration `yaml:"ttl,omitempty"`
+}
+
+// MarshalJSON writes the TTL in duration syntax.
+func (g ProfileGroup) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Paths []string `json:"paths"`
+		TTL   string   `json:"ttl"`
+	}{g.Paths, g.TTL.String()})
+}
+
+// Profile is a resolved repository profile. Metadata is the index a client
+// reads first and changes in place; artifacts are the files it points to,
+// which never change once published.
+type Profile struct {
+	Name      string       `json:"name"`
+	Builtin   bool         `json:"builtin"`
+	Enabled   bool         `json:"enabled"`
+	Hosts     []string     `json:"hosts,omitempty"`
+	Metadata  ProfileGroup `json:"metadata"`
+	Artifacts ProfileGroup `json:"artifacts"`
+}
+
+const immutableTTL = 30 * 24 * time.Hour
+
+var builtinProfiles = []Profile{
+	{
+		Name:    "debian",
+		Enabled: true,
+		Metadata: ProfileGroup{
+			Paths: StringList{"*/InRelease", "*/Release", "*/Release.gpg", "*/Packages*", "*/Sources*",
+				"*/Contents-*", "*/Translation-*", "*/Components-*", "*/icons-*"},
+			TTL: 5 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"*/by-hash/*", "*.deb", "*.udeb", "*.ddeb", "*.dsc"},
+			TTL:   immutableTTL,
+		},
+	},
+	{
+		Name: "rhel",
+		Metadata: ProfileGroup{
+			Paths: StringList{"*/repodata/repomd.xml*", "*/repodata/*primary.xml*", "*/repodata/*filelists.xml*",
+				"*/repodata/*other.xml*", "*/repodata/*comps*", "*/repodata/*updateinfo*", "*/repodata/*modules.yaml*",
+				"*/metalink", "*/mirrorlist"},
+			TTL: 10 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"*.rpm", "*.drpm"},
+			TTL:   immutableTTL,
+		},
+	},
+	{
+		Name: "alpine",
+		Metadata: ProfileGroup{
+			Paths: StringList{"*/APKINDEX.tar.gz"},
+			TTL:   10 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"*.apk"},
+			TTL:   immutableTTL,
+		},
+	},
+	{
+		Name: "arch",
+		Metadata: ProfileGroup{
+			Paths: StringList{"*.db", "*.db.sig", "*.files", "*.files.sig"},
+			TTL:   10 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"*.pkg.tar.*"},
+			TTL:   immutableTTL,
+		},
+	},
+	{
+		Name: "opensuse",
+		Metadata: ProfileGroup{
+			Paths: StringList{"*/repodata/repomd.xml*", "*/repodata/*primary.xml*", "*/repodata/*filelists.xml*",
+				"*/repodata/*other.xml*", "*/repodata/*susedata*", "*/repodata/*updateinfo*", "*/media.1/*", "*/content"},
+			TTL: 10 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"*.rpm", "*.drpm"},
+			TTL:   immutableTTL,
+		},
+	},
+	{
+		Name: "pypi",
+		Metadata: ProfileGroup{
+			Paths: StringList{"*/simple/*", "*/pypi/*/json"},
+			TTL:   10 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"/packages/*", "*.whl"},
+			TTL:   immutableTTL,
+		},
+	},
+	{
+		Name:  "npm",
+		Hosts: []string{"registry.npmjs.org", "registry.yarnpkg.com"},
+		Metadata: ProfileGroup{
+			Paths: StringList{"*"},
+			TTL:   5 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"*/-/*.tgz"},
+			TTL:   immutableTTL,
+		},
+	},
+	{
+		Name: "goproxy",
+		Metadata: ProfileGroup{
+			Paths: StringList{"*/@v/list", "*/@latest"},
+			TTL:   10 * time.Minute,
+		},
+		Artifacts: ProfileGroup{
+			Paths: StringList{"*/@v/*.info", "*/@v/*.mod", "*/@v/*.zip"},
+			TTL:   immutableTTL,
+		},
+	},
+}
+
+// Resolve applies the overrides to the built-in profiles and returns every
+// profile, enabled or not: built-in ones first, then the others by name.
+func (p ProfilesConfig) Resolve() ([]Profile, error) {
+	profiles := make([]Profile, 0, len(builtinProfiles)+len(p))
+	known := make(map[string]bool)
+
+	for _, b := range builtinProfiles {
+		known[b.Name] = true
+		profile := b
+		profile.Builtin = true
+		if override, ok := p[b.Name]; ok {
+			profile = override.apply(profile)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	var custom []string
+	for name := range p {
+		if !known[name] {
+			custom = append(custom, name)
+		}
+	}
+	sort.Strings(custom)
+	for _, name := range custom {
+		profile := p[name].apply(Profile{Name: name, Enabled: true})
+		if len(profile.Metadata.Paths) == 0 && len(profile.Artifacts.Paths) == 0 {
+			return nil, fmt.Errorf("profile %s: not a built-in profile and has no metadata or artifacts paths", name)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+func (p ProfilesConfig) validate(v *validator) {
+	known := make(map[string]bool)
+	for _, b := range builtinProfiles {
+		known[b.Name] = true
+	}
+
+	for name, o := range p {
+		path := "profiles" + mapKey(name)
+		if !known[name] && len(o.Metadata.Paths) == 0 && len(o.Artifacts.Paths) == 0 {
+			v.errorf(path, "not a built-in profile and has no metadata or artifacts paths")
+		}
+		checkHostPatterns(v, path+".hosts", o.Hosts)
+		checkPathPatterns(v, path+".metadata.paths", o.Metadata.Paths)
+		checkPathPatterns(v, path+".artifacts.paths", o.Artifacts.Paths)
+		if o.Metadata.TTL < 0 {
+			v.errorf(path+".metadata.ttl", "must not be negative")
+		}
+		if o.Artifacts.TTL < 0 {
+			v.errorf(path+".artifacts.ttl", "must not be negative")
+		}
+	}
+}
+
+func (o ProfileConfig) apply(p Profile) Profile {
+	if o.Enabled != nil {
+		p.Enabled = *o.Enabled
+	}
+	if len(o.Hosts) > 0 {
+		p.Hosts = o.Hosts
+	}
+	if len(o.Metadata.Paths) > 0 {
+		p.Metadata.Paths = o.Metadata.Paths
+	}
+	if o.Metadata.TTL > 0 {
+		p.Metadata.TTL = o.Metadata.TTL
+	}
+	if len(o.Artifacts.Paths) > 0 {
+		p.Artifacts.Paths = o.Artifacts.Paths
+	}
+	if o.Artifacts.TTL > 0 {
+		p.Artifacts.TTL = o.Artifacts.TTL
+	}
+	return p
+}
@@ -0,0 +1,45 @@
+package config
+
+import "reflect"
+
+// restartOnly lists the settings a running server cannot change: listeners,
+// the cache directory and its background jobs, the access log and tracing.
+var restartOnly = []struct {
+	path  string
+	field func(c *Config) interface{}
+}{
+	{"server.host", func(c *Config) interface{} { return &c.Server.Host }},
+	{"server.port", func(c *Config) interface{} { return &c.Server.Port }},
+	{"admin.enabled", func(c *Config) interface{} { return &c.Admin.Enabled }},
+	{"admin.host", func(c *Config) interface{} { return &c.Admin.Host }},
+	{"admin.port", func(c *Config) interface{} { return &c.Admin.Port }},
+	{"cache.directory", func(c *Config) interface{} { return &c.Cache.Directory }},
+	{"cache.buffer_size_kb", func(c *Config) interface{} { return &c.Cache.BufferSizeKB }},
+	{"cache.scavenge_interval", func(c *Config) interface{} { return &c.Cache.ScavengeInterval }},
+	{"cache.scrub_interval", func(c *Config) interface{} { return &c.Cache.ScrubInterval }},
+	{"access_log", func(c *Config) interface{} { return &c.AccessLog }},
+	{"tracing", func(c *Config) interface{} { return &c.Tracing }},
+}
+
+// CarryOver copies the settings that need a restart to change from the
+// running configuration into c, so c describes what will actually be in
+// effect after a reload. It returns the paths of those that differ, and an
+// error if c is not valid once they are copied, such as when a reload drops
+// the admin credentials but the admin API stays on a public address.
+func (c *Config) CarryOver(running *Config) ([]string, error) {
+	var changed []string
+	for _, s := range restartOnly {
+		dst := reflect.ValueOf(s.field(c)).Elem()
+		src := reflect.ValueOf(s.field(running)).Elem()
+		if !reflect.DeepEqual(dst.Interface(), src.Interface()) {
+			changed = append(changed, s.path)
+			dst.Set(src)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	v := newValidator()
+	c.validate(v)
+	return changed, v.err()
+}
@@ -0,0 +1,262 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions.
+const (
+	ActionCache  = "cache"
+	ActionBypass = "bypass"
+	ActionDeny   = "deny"
+	ActionTunnel = "tunnel"
+)
+
+// RulesConfig accepts two forms. The legacy form is a mapping with
+// passthrough, https_passthrough and special_ttl keys; the current form is an
+// ordered list of rules, kept in List.
+type RulesConfig struct {
+	Passthrough      []string          `yaml:"passthrough,omitempty"`
+	HTTPSPassthrough []string          `yaml:"https_passthrough,omitempty"`
+	SpecialTTL       map[string]string `yaml:"special_ttl,omitempty"`
+
+	List []RuleConfig `yaml:"-"`
+}
+
+// RuleConfig is one entry of the rules list. All criteria in Match must hold
+// for the rule to apply; the first applicable rule, by descending Priority
+// and then file order, decides.
+type RuleConfig struct {
+	Name     string      `yaml:"name,omitempty"`
+	Priority int         `yaml:"priority,omitempty"`
+	Match    MatchConfig `yaml:"match"`
+	// Action is cache, bypass, deny or tunnel. It defaults to cache.
+	Action string        `yaml:"action,omitempty"`
+	TTL    time.Duration `yaml:"ttl,omitempty"`
+	// MinTTL and MaxTTL clamp the TTL after Cache-Control is applied.
+	MinTTL  time.Duration `yaml:"min_ttl,omitempty"`
+	MaxTTL  time.Duration `yaml:"max_ttl,omitempty"`
+	Headers HeaderRewrite `yaml:"headers,omitempty"`
+}
+
+// MatchConfig lists the criteria of a rule. Empty criteria match anything.
+// Host, path and content type patterns are globs where "*" matches any run of
+// characters and "?" one character.
+type MatchConfig struct {
+	Host        StringList `yaml:"host,omitempty"`
+	Path        StringList `yaml:"path,omitempty"`
+	Regex       string     `yaml:"regex,omitempty"` // against the full URL
+	Method      StringList `yaml:"method,omitempty"`
+	ContentType StringList `yaml:"content_type,omitempty"`
+	Status      []int      `yaml:"status,omitempty"`
+	MinSize     ByteSize   `yaml:"min_size,omitempty"`
+	MaxSize     ByteSize   `yaml:"max_size,omitempty"`
+}
+
+// NeedsResponse reports whether the criteria can only be checked once the
+// upstream response has arrived.
+func (m MatchConfig) NeedsResponse() bool {
+	return len(m.ContentType) > 0 || len(m.Status) > 0 || m.MinSize > 0 || m.MaxSize > 0
+}
+
+// HeaderRewrite changes response headers before they are sent and stored.
+type HeaderRewrite struct {
+	Set    map[string]string `yaml:"set,omitempty"`
+	Remove []string          `yaml:"remove,omitempty"`
+}
+
+func (h HeaderRewrite) IsZero() bool {
+	return len(h.Set) == 0 && len(h.Remove) == 0
+}
+
+func (r *RulesConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&r.List)
+	}
+	type plain RulesConfig
+	return node.Decode((*plain)(r))
+}
+
+func (r RulesConfig) MarshalYAML() (interface{}, error) {
+	if len(r.List) > 0 {
+		return r.List, nil
+	}
+	type plain RulesConfig
+	return plain(r), nil
+}
+
+// IsLegacy reports whether the rules use the passthrough/special_ttl form.
+func (r *RulesConfig) IsLegacy() bool {
+	return len(r.List) == 0
+}
+
+func (r *RulesConfig) validate(v *validator) {
+	for i, pattern := range r.Passthrough {
+		if pattern == "" {
+			v.errorf(fmt.Sprintf("rules.passthrough[%d]", i), "empty pattern")
+		}
+	}
+	for i, pattern := range r.HTTPSPassthrough {
+		if pattern == "" {
+			v.errorf(fmt.Sprintf("rules.https_passthrough[%d]", i), "empty pattern")
+		}
+	}
+	for pattern, ttlStr := range r.SpecialTTL {
+		path := "rules.special_ttl" + mapKey(pattern)
+		if pattern == "" {
+			v.errorf(path, "empty pattern")
+		}
+		if ttl, err := time.ParseDuration(ttlStr); err != nil {
+			v.errorf(path, "invalid TTL %q", ttlStr)
+		} else if ttl < 0 {
+			v.errorf(path, "TTL must not be negative")
+		}
+	}
+
+	for i, rule := range r.List {
+		rule.validate(v, fmt.Sprintf("rules[%d]", i))
+	}
+}
+
+func (r RuleConfig) validate(v *validator, path string) {
+	switch r.Action {
+	case "", ActionCache, ActionBypass, ActionDeny, ActionTunnel:
+	default:
+		v.errorf(path+".action", "unknown action %q (want cache, bypass, deny or tunnel)", r.Action)
+	}
+
+	m := r.Match
+	checkHostPatterns(v, path+".match.host", m.Host)
+	checkPathPatterns(v, path+".match.path", m.Path)
+	if m.Regex != "" {
+		if _, err := regexp.Compile(m.Regex); err != nil {
+			v.errorf(path+".match.regex", "invalid regex: %v", err)
+		}
+	}
+	for i, method := range m.Method {
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			v.errorf(fmt.Sprintf("%s.match.method[%d]", path, i), "invalid method %q", method)
+		}
+	}
+	for i, ct := range m.ContentType {
+		if !strings.Contains(ct, "/") && ct != "*" {
+			v.errorf(fmt.Sprintf("%s.match.content_type[%d]", path, i), "%q is not a media type pattern such as text/* or application/json", ct)
+		}
+	}
+	for i, status := range m.Status {
+		if status < 100 || status > 599 {
+			v.errorf(fmt.Sprintf("%s.match.status[%d]", path, i), "invalid status code %d", status)
+		}
+	}
+	if m.MinSize > 0 && m.MaxSize > 0 && m.MinSize > m.MaxSize {
+		v.errorf(path+".match.min_size", "is greater than max_size")
+	}
+
+	if r.TTL < 0 {
+		v.errorf(path+".ttl", "must not be negative")
+	}
+	if r.MinTTL < 0 {
+		v.errorf(path+".min_ttl", "must not be negative")
+	}
+	if r.MaxTTL < 0 {
+		v.errorf(path+".max_ttl", "must not be negative")
+	}
+	if r.MinTTL > 0 && r.MaxTTL > 0 && r.MinTTL > r.MaxTTL {
+		v.errorf(path+".min_ttl", "%s is greater than max_ttl %s", r.MinTTL, r.MaxTTL)
+	}
+	if r.Action == ActionTunnel && (m.Regex != "" || len(m.Path) > 0 || m.NeedsResponse()) {
+		v.errorf(path+".match", "tunnel rules can only match on host")
+	}
+}
+
+// checkHostPatterns reports host patterns that look like URLs.
+func checkHostPatterns(v *validator, path string, patterns []string) {
+	for i, pattern := range patterns {
+		if pattern == "" || strings.ContainsAny(pattern, "/:") {
+			v.errorf(fmt.Sprintf("%s[%d]", path, i), "%q is not a host pattern such as *.example.com", pattern)
+		}
+	}
+}
+
+// checkPathPatterns reports path patterns that can never match because URL
+// paths always start with "/".
+func checkPathPatterns(v *validator, path string, patterns []string) {
+	for i, pattern := range patterns {
+		if pattern == "" || !strings.ContainsAny(pattern[:1], "/*?") {
+			v.errorf(fmt.Sprintf("%s[%d]", path, i), "%q never matches: paths start with \"/\", so start the pattern with \"/\" or \"*\"", pattern)
+		}
+	}
+}
+
+// StringList is a list of strings that may also be written as a single
+// scalar.
+type StringList []string
+
+func (s *StringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = StringList{node.Value}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// ByteSize is a size in bytes written as a plain number or with a K, M, G or
+// T suffix (binary multiples; a trailing "B" or "iB" is accepted).
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	n, err := ParseSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return int64(b), nil
+}
+
+// ParseSize parses a size such as "512", "64K", "10MB" or "1.5GiB".
+func ParseSize(s string) (int64, error) {
+	orig := s
+	s = strings.TrimSpace(strings.ToUpper(s))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+
+	multiplier := 1.0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", orig)
+	}
+	return int64(n * multiplier), nil
+}
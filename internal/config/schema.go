@@ -0,0 +1,97 @@
+package config
+
+//go:generate sh -c "cd ../.. && go run ./cmd/cascade config schema > config.schema.json"
+
+import "reflect"
+
+const (
+	durationPattern = `^(0|-?([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+	sizePattern     = `^[0-9]+(\.[0-9]+)?\s*([KkMmGgTt](i?[Bb])?|[Bb])?$`
+)
+
+// schemaExtras adds constraints the Go types cannot express, by path.
+var schemaExtras = map[string]map[string]interface{}{
+	"server.port":          {"minimum": 1, "maximum": 65535},
+	"admin.port":           {"minimum": 1, "maximum": 65535},
+	"server.connect_ports": {"items": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 65535}},
+	"acl[].action":         {"enum": []string{ACLAllow, ACLDeny}},
+	"acl[].ports":          {"items": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 65535}},
+	"mirrors[].select":     {"enum": []string{MirrorSelectLatency, MirrorSelectOrder}},
+	"limits.key":           {"enum": []string{LimitKeyIP, LimitKeyUser}},
+	"cache.checksum":       {"enum": []string{"sha256", "sha512", "none"}},
+	"egress.proxy_type":    {"enum": []string{"http", "socks5"}},
+	"access_log.format":    {"enum": []string{"squid", "combined", "json"}},
+	"log.level":            {"enum": []string{"debug", "info", "warn", "error"}},
+	"log.format":           {"enum": []string{"text", "json"}},
+	"tracing.sample_ratio": {"minimum": 0, "maximum": 1},
+	"rules[].action":       {"enum": []string{ActionCache, ActionBypass, ActionDeny, ActionTunnel}},
+	"rules[].match.status": {"items": map[string]interface{}{"type": "integer", "minimum": 100, "maximum": 599}},
+}
+
+// Schema returns a JSON Schema describing the configuration file, derived
+// from the Config types.
+func Schema() map[string]interface{} {
+	s := schemaFor(reflect.TypeOf(Config{}), "")
+	s["properties"].(map[string]interface{})[includeKey] = schemaFor(reflect.TypeOf(StringList(nil)), includeKey)
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "Cascade configuration"
+	return s
+}
+
+func schemaFor(t reflect.Type, path string) map[string]interface{} {
+	s := baseSchema(t, path)
+	for k, v := range schemaExtras[path] {
+		s[k] = v
+	}
+	return s
+}
+
+func baseSchema(t reflect.Type, path string) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case durationType:
+		return map[string]interface{}{"type": "string", "pattern": durationPattern}
+	case reflect.TypeOf(StringList(nil)):
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		}}
+	case reflect.TypeOf(ByteSize(0)):
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "integer", "minimum": 0},
+			map[string]interface{}{"type": "string", "pattern": sizePattern},
+		}}
+	case reflect.TypeOf(RulesConfig{}):
+		type plain RulesConfig
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "array", "items": schemaFor(reflect.TypeOf(RuleConfig{}), path+"[]")},
+			schemaFor(reflect.TypeOf(plain{}), path),
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for name, f := range yamlFields(t) {
+			props[name] = schemaFor(f.Type, joinPath(path, name))
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), path+".*")}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), path+"[]")}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"cascade/internal/match"
+)
+
+// UpstreamsConfig limits how many requests Cascade sends to each origin host
+// at once and stops sending requests to hosts that keep failing.
+type UpstreamsConfig struct {
+	// Default applies to every host; settings in a matching PerHost entry
+	// replace it.
+	Default UpstreamConfig `yaml:"default"`
+	// PerHost entries are tried in order and the first whose hosts match
+	// applies. Settings left at zero are taken from Default.
+	PerHost []UpstreamHostConfig `yaml:"per_host"`
+}
+
+type UpstreamHostConfig struct {
+	// Hosts are globs matched against the whole origin host name, ignoring
+	// case.
+	Hosts          StringList `yaml:"hosts"`
+	UpstreamConfig `yaml:",inline"`
+}
+
+type UpstreamConfig struct {
+	// MaxConnections is how many requests to one host may run at once;
+	// further requests queue. A negative value means no limit.
+	MaxConnections int `yaml:"max_connections"`
+	// QueueTimeout is how long a queued request waits for its turn before it
+	// fails. A negative value fails it at once.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	Breaker      BreakerConfig `yaml:"breaker"`
+	// ResumeRetries is how many times a download being cached that breaks
+	// off is resumed with a Range request before it fails. A negative value
+	// disables resuming.
+	ResumeRetries int `yaml:"resume_retries"`
+}
+
+// BreakerConfig configures the circuit breaker kept for each host. After
+// Failures consecutive failures it opens and requests to the host fail at
+// once, or are served stale from the cache, for OpenFor; then a single trial
+// request decides whether it closes again.
+type BreakerConfig struct {
+	// Failures is how many consecutive connection errors or 5xx responses
+	// open the breaker. A negative value disables it.
+	Failures int           `yaml:"failures"`
+	OpenFor  time.Duration `yaml:"open_for"`
+}
+
+// For returns the settings for host.
+func (u UpstreamsConfig) For(host string) UpstreamConfig {
+	host = strings.ToLower(host)
+	for _, entry := range u.PerHost {
+		for _, pattern := range entry.Hosts {
+			if match.Wildcard(host, strings.ToLower(pattern)) {
+				return entry.UpstreamConfig.inherit(u.Default)
+			}
+		}
+	}
+	return u.Default
+}
+
+// inherit fills the settings left at zero in c from def.
+func (c UpstreamConfig) inherit(def UpstreamConfig) UpstreamConfig {
+	if c.MaxConnections == 0 {
+		c.MaxConnections = def.MaxConnections
+	}
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = def.QueueTimeout
+	}
+	if c.Breaker.Failures == 0 {
+		c.Breaker.Failures = def.Breaker.Failures
+	}
+	if c.Breaker.OpenFor == 0 {
+		c.Breaker.OpenFor = def.Breaker.OpenFor
+	}
+	if c.ResumeRetries == 0 {
+		c.ResumeRetries = def.ResumeRetries
+	}
+	return c
+}
+
+func (u *UpstreamsConfig) setDefaults() {
+	u.Default = u.Default.inherit(UpstreamConfig{
+		MaxConnections: 100,
+		QueueTimeout:   30 * time.Second,
+		Breaker:        BreakerConfig{Failures: 5, OpenFor: 30 * time.Second},
+		ResumeRetries:  3,
+	})
+}
+
+func (u UpstreamsConfig) validate(v *validator) {
+	if u.Default.Breaker.OpenFor < 0 {
+		v.errorf("upstreams.default.breaker.open_for", "must not be negative")
+	}
+	for i, entry := range u.PerHost {
+		path := fmt.Sprintf("upstreams.per_host[%d]", i)
+		if len(entry.Hosts) == 0 {
+			v.errorf(path+".hosts", "must list at least one host")
+		}
+		if entry.Breaker.OpenFor < 0 {
+			v.errorf(path+".breaker.open_for", "must not be negative")
+		}
+	}
+}
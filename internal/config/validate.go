@@ -0,0 +1,484 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"cascade/internal/accesslog"
+	"cascade/internal/cache"
+	"cascade/internal/logging"
+)
+
+// Problem is one error or warning found in a configuration file. Path names
+// the setting, e.g. cache.max_file_size_mb or rules[2].match.regex; Line is
+// zero when the setting is not in the file. File is set when the setting
+// comes from an included file; Source names the environment variable or
+// flag that set it, if any.
+type Problem struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	if p.File != "" {
+		s = p.File + ": " + s
+	}
+	if p.Source != "" {
+		s = p.Source + ": " + s
+	}
+	return s
+}
+
+// ValidationError lists every error found in a configuration file.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// validator collects problems, looking up where each setting came from: a
+// line in the configuration file or an included one, or an override.
+type validator struct {
+	root     *yaml.Node
+	read     []string
+	files    map[*yaml.Node]string
+	sources  map[string]string
+	errors   []Problem
+	warnings []Problem
+}
+
+func newValidator() *validator {
+	return &validator{
+		root:    &yaml.Node{},
+		files:   make(map[*yaml.Node]string),
+		sources: make(map[string]string),
+	}
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, v.problem(path, v.locate(path), fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) warnf(path, format string, args ...interface{}) {
+	v.warnings = append(v.warnings, v.problem(path, v.locate(path), fmt.Sprintf(format, args...)))
+}
+
+// problem returns a problem at path, attributed to the override that set
+// path or one of its parents if there is one, else to the node at.
+func (v *validator) problem(path string, at *yaml.Node, msg string) Problem {
+	for p := path; p != ""; p = parentPath(p) {
+		if source, ok := v.sources[p]; ok {
+			return Problem{Source: source, Path: path, Message: msg}
+		}
+	}
+	if at == nil {
+		return Problem{Path: path, Message: msg}
+	}
+	return Problem{File: v.files[at], Line: at.Line, Path: path, Message: msg}
+}
+
+// parentPath strips the last key or index from path.
+func parentPath(path string) string {
+	if strings.HasSuffix(path, `"]`) {
+		if i := strings.LastIndex(path, `["`); i >= 0 {
+			return path[:i]
+		}
+	}
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	sortProblems(v.errors)
+	return &ValidationError{Problems: v.errors}
+}
+
+// sortProblems orders problems by file, with the main file first, then by
+// line and path; problems without a line come last.
+func sortProblems(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if (a.Line == 0) != (b.Line == 0) {
+			return b.Line == 0
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Path < b.Path
+	})
+}
+
+// decodeError records the errors from decoding file into Config. Values that
+// could not be decoded are left at their defaults, so validation can carry on
+// and report everything at once.
+func (v *validator) decodeError(file string, err error) {
+	msgs := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	}
+	for _, msg := range msgs {
+		p := Problem{File: file, Message: msg}
+		var line int
+		if n, _ := fmt.Sscanf(msg, "line %d:", &line); n == 1 {
+			p.Line = line
+			_, p.Message, _ = strings.Cut(msg, ": ")
+		}
+		v.errors = append(v.errors, p)
+	}
+}
+
+// locate returns the key or list item of the setting at path, or of its
+// closest parent that is in the file; nil if there is none.
+func (v *validator) locate(path string) *yaml.Node {
+	node := v.root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	var at *yaml.Node
+	for _, seg := range splitPath(path) {
+		var next *yaml.Node
+		switch {
+		case node.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == seg {
+					at = node.Content[i]
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case node.Kind == yaml.SequenceNode:
+			if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+				at = next
+			}
+		}
+		if next == nil {
+			return at
+		}
+		node = next
+	}
+	return at
+}
+
+// splitPath splits a path such as rules.special_ttl["*.deb"] or rules[2].ttl
+// into its keys and indexes.
+func splitPath(path string) []string {
+	var segs []string
+	for path != "" {
+		switch {
+		case strings.HasPrefix(path, `["`):
+			end := strings.Index(path, `"]`)
+			if end < 0 {
+				return append(segs, path[2:])
+			}
+			segs = append(segs, path[2:end])
+			path = path[end+2:]
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return append(segs, path[1:])
+			}
+			segs = append(segs, path[1:end])
+			path = path[end+1:]
+		case path[0] == '.':
+			path = path[1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			segs = append(segs, path[:end])
+			path = path[end:]
+		}
+	}
+	return segs
+}
+
+// mapKey renders a map key as a path segment.
+func mapKey(key string) string {
+	return fmt.Sprintf("[%q]", key)
+}
+
+var (
+	durationType   = reflect.TypeOf(time.Duration(0))
+	unmarshalerTyp = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+)
+
+// checkFields reports keys in node that the type t has no field for.
+func (v *validator) checkFields(node *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.DocumentNode {
+		for _, n := range node.Content {
+			v.checkFields(n, t, path)
+		}
+		return
+	}
+	if node.Kind == yaml.AliasNode {
+		return
+	}
+
+	if t == reflect.TypeOf(RulesConfig{}) {
+		if node.Kind == yaml.SequenceNode {
+			v.checkFields(node, reflect.TypeOf([]RuleConfig(nil)), path)
+			return
+		}
+		type plain RulesConfig
+		v.checkFields(node, reflect.TypeOf(plain{}), path)
+		return
+	}
+	if t == durationType || reflect.PtrTo(t).Implements(unmarshalerTyp) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldPath := joinPath(path, key.Value)
+			field, ok := fields[key.Value]
+			if !ok {
+				v.errors = append(v.errors, v.problem(fieldPath, key, "unknown setting"))
+				continue
+			}
+			v.checkFields(node.Content[i+1], field.Type, fieldPath)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkFields(node.Content[i+1], t.Elem(), path+mapKey(node.Content[i].Value))
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, n := range node.Content {
+			v.checkFields(n, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// yamlFields maps the YAML keys of struct type t to its fields, following
+// inlined structs.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// checkURL reports a problem unless raw is an absolute URL with one of the
+// given schemes and a host.
+func (v *validator) checkURL(path, raw string, schemes ...string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.errorf(path, "invalid URL: %v", err)
+		return
+	}
+	ok := false
+	for _, s := range schemes {
+		if u.Scheme == s {
+			ok = true
+		}
+	}
+	if !ok {
+		v.errorf(path, "URL scheme must be %s, got %q", strings.Join(schemes, " or "), u.Scheme)
+		return
+	}
+	if u.Host == "" {
+		v.errorf(path, "URL has no host")
+	}
+}
+
+// isLoopbackHost reports whether a listener on host is only reachable from
+// this machine.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validate checks the whole configuration after defaults have been applied.
+func (c *Config) validate(v *validator) {
+	if !validPort(c.Server.Port) {
+		v.errorf("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+
+	if c.Admin.Enabled {
+		if !validPort(c.Admin.Port) {
+			v.errorf("admin.port", "must be between 1 and 65535, got %d", c.Admin.Port)
+		} else if c.Admin.Port == c.Server.Port && (c.Admin.Host == c.Server.Host || c.Server.Host == "0.0.0.0") {
+			v.errorf("admin.port", "the admin API and the proxy cannot share port %d", c.Admin.Port)
+		}
+		if (c.Admin.Username == "") != (c.Admin.Password == "") {
+			v.errorf("admin.username", "username and password must be set together")
+		}
+		if c.Admin.Token == "" && c.Admin.Username == "" && !isLoopbackHost(c.Admin.Host) {
+			v.errorf("admin.host", "%s is not a loopback address; set admin.token or admin.username and admin.password to listen on it", c.Admin.Host)
+		}
+	}
+
+	if c.Cache.MaxSizeGB <= 0 {
+		v.errorf("cache.max_size_gb", "must be positive")
+	}
+	if c.Cache.MinFileSizeKB < 0 {
+		v.errorf("cache.min_file_size_kb", "must not be negative")
+	}
+	if c.Cache.MaxFileSizeMB < 0 {
+		v.errorf("cache.max_file_size_mb", "must not be negative")
+	}
+	if c.Cache.MinFileSizeKB > 0 && c.Cache.MaxFileSizeMB > 0 && c.Cache.MinFileSizeKB > c.Cache.MaxFileSizeMB*1024 {
+		v.errorf("cache.min_file_size_kb", "%d KB is larger than max_file_size_mb (%d MB)", c.Cache.MinFileSizeKB, c.Cache.MaxFileSizeMB)
+	}
+	if c.Cache.DefaultTTL < 0 {
+		v.errorf("cache.default_ttl", "must not be negative")
+	}
+	if c.Cache.BufferSizeKB < 0 {
+		v.errorf("cache.buffer_size_kb", "must not be negative")
+	}
+	if !cache.ValidChecksumAlgorithm(c.Cache.Checksum) {
+		v.errorf("cache.checksum", "must be sha256, sha512 or none, got %q", c.Cache.Checksum)
+	}
+
+	switch {
+	case c.Egress.Enabled:
+		switch c.Egress.ProxyType {
+		case "http":
+			v.checkURL("egress.proxy_url", c.Egress.ProxyURL, "http", "https")
+		case "socks5":
+			v.checkURL("egress.proxy_url", c.Egress.ProxyURL, "socks5", "socks5h")
+		default:
+			v.errorf("egress.proxy_type", "must be http or socks5, got %q", c.Egress.ProxyType)
+		}
+	case c.Egress.ProxyURL != "":
+		v.warnf("egress.enabled", "egress.proxy_url is set but ignored because egress is not enabled")
+	}
+
+	c.Rules.validate(v)
+	c.Profiles.validate(v)
+	c.Destinations.validate(v, c.Egress.Enabled)
+	c.Auth.validate(v)
+	for i, rule := range c.ACL {
+		rule.validate(v, fmt.Sprintf("acl[%d]", i))
+	}
+	c.checkACLUsers(v)
+	c.Limits.validate(v, c.Auth.Enabled())
+	c.Upstreams.validate(v)
+	mirrorsSeen := make(map[string]string)
+	for i, pool := range c.Mirrors {
+		pool.validate(v, fmt.Sprintf("mirrors[%d]", i), mirrorsSeen)
+	}
+	if c.Cache.StaleIfError < 0 {
+		v.errorf("cache.stale_if_error", "must not be negative")
+	}
+	for i, port := range c.Server.ConnectPorts {
+		if !validPort(port) {
+			v.errorf(fmt.Sprintf("server.connect_ports[%d]", i), "must be between 1 and 65535, got %d", port)
+		}
+	}
+
+	for i, g := range c.Metrics.HostGroups {
+		path := fmt.Sprintf("metrics.host_groups[%d]", i)
+		if g.Name == "" {
+			v.errorf(path+".name", "must not be empty")
+		}
+		if len(g.Hosts) == 0 {
+			v.errorf(path+".hosts", "must list at least one host pattern")
+		}
+	}
+
+	if c.AccessLog.Path != "" && !accesslog.ValidFormat(c.AccessLog.Format) {
+		v.errorf("access_log.format", "must be squid, combined or json, got %q", c.AccessLog.Format)
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		v.errorf("log.level", "must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	if !logging.ValidFormat(c.Log.Format) {
+		v.errorf("log.format", "must be text or json, got %q", c.Log.Format)
+	}
+	subsystems := logging.Subsystems()
+	for i, name := range c.Log.Debug {
+		if _, ok := subsystems[name]; !ok {
+			v.errorf(fmt.Sprintf("log.debug[%d]", i), "unknown subsystem %q", name)
+		}
+	}
+
+	if c.Tracing.Enabled {
+		v.checkURL("tracing.endpoint", c.Tracing.Endpoint, "http", "https")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		v.errorf("tracing.sample_ratio", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+}
@@ -1,6 +1,7 @@
 package lock
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -26,40 +27,89 @@ func NewFileLock() *FileLock {
 }
 
 func (fl *FileLock) Lock(path string) (func(), error) {
-	fl.mu.Lock()
-	entry, exists := fl.locks[path]
-	if !exists {
-		entry = &lockEntry{}
-		fl.locks[path] = entry
-	}
-	entry.refcnt++
-	fl.mu.Unlock()
-
+	entry := fl.acquire(path)
 	entry.mu.Lock()
 
 	if entry.file == nil {
-		lockPath := path + ".lock"
-		if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		file, err := openLockFile(path)
+		if err != nil {
+			entry.mu.Unlock()
+			fl.release(path, entry)
+			return nil, err
+		}
+
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
 			entry.mu.Unlock()
-			return nil, fmt.Errorf("failed to create lock directory: %w", err)
+			fl.release(path, entry)
+			return nil, fmt.Errorf("failed to acquire file lock: %w", err)
 		}
 
-		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+		entry.file = file
+	}
+
+	return fl.unlockFunc(path, entry), nil
+}
+
+// TryLock is like Lock but does not block. It reports false when the path is
+// currently held, either by this process or by another process sharing the
+// same directory.
+func (fl *FileLock) TryLock(path string) (func(), bool, error) {
+	entry := fl.acquire(path)
+	if !entry.mu.TryLock() {
+		fl.release(path, entry)
+		return nil, false, nil
+	}
+
+	if entry.file == nil {
+		file, err := openLockFile(path)
 		if err != nil {
 			entry.mu.Unlock()
-			return nil, fmt.Errorf("failed to create lock file: %w", err)
+			fl.release(path, entry)
+			return nil, false, err
 		}
 
-		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
 			file.Close()
 			entry.mu.Unlock()
-			return nil, fmt.Errorf("failed to acquire file lock: %w", err)
+			fl.release(path, entry)
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, false, nil
+			}
+			return nil, false, fmt.Errorf("failed to acquire file lock: %w", err)
 		}
 
 		entry.file = file
 	}
 
-	unlockFn := func() {
+	return fl.unlockFunc(path, entry), true, nil
+}
+
+func (fl *FileLock) acquire(path string) *lockEntry {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	entry, exists := fl.locks[path]
+	if !exists {
+		entry = &lockEntry{}
+		fl.locks[path] = entry
+	}
+	entry.refcnt++
+	return entry
+}
+
+func (fl *FileLock) release(path string, entry *lockEntry) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	entry.refcnt--
+	if entry.refcnt == 0 {
+		delete(fl.locks, path)
+	}
+}
+
+func (fl *FileLock) unlockFunc(path string, entry *lockEntry) func() {
+	return func() {
 		if entry.file != nil {
 			syscall.Flock(int(entry.file.Fd()), syscall.LOCK_UN)
 			entry.file.Close()
@@ -68,13 +118,19 @@ func (fl *FileLock) Lock(path string) (func(), error) {
 		}
 		entry.mu.Unlock()
 
-		fl.mu.Lock()
-		entry.refcnt--
-		if entry.refcnt == 0 {
-			delete(fl.locks, path)
-		}
-		fl.mu.Unlock()
+		fl.release(path, entry)
 	}
+}
 
-	return unlockFn, nil
+func openLockFile(path string) (*os.File, error) {
+	lockPath := path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock file: %w", err)
+	}
+	return file, nil
 }
@@ -0,0 +1,185 @@
+// Package logging configures the diagnostic log. Every subsystem logs through
+// its own slog.Logger, obtained with For, whose debug output can be switched
+// on and off at runtime without touching the global level.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	level = new(slog.LevelVar)
+	root  atomic.Pointer[rootHandler]
+
+	mu         sync.Mutex
+	subsystems = make(map[string]*subsystem)
+)
+
+type rootHandler struct {
+	handler slog.Handler
+	format  string
+}
+
+func init() {
+	root.Store(&rootHandler{handler: newHandler(os.Stderr, FormatText), format: FormatText})
+}
+
+// ValidFormat reports whether format names a supported output format.
+func ValidFormat(format string) bool {
+	return format == FormatText || format == FormatJSON
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level: %s", s)
+	}
+	return l, nil
+}
+
+// Setup directs every logger to w in the given format at the given level and
+// makes the standard library log package write through the "main" logger.
+func Setup(w io.Writer, levelName, format string) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	if !ValidFormat(format) {
+		return fmt.Errorf("unsupported log format: %s", format)
+	}
+
+	level.Set(l)
+	root.Store(&rootHandler{handler: newHandler(w, format), format: format})
+	slog.SetDefault(For("main"))
+	return nil
+}
+
+func newHandler(w io.Writer, format string) slog.Handler {
+	// Filtering happens in handler.Enabled; the root handler accepts all.
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == FormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// Level returns the global log level.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// SetLevel changes the global log level.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// Format returns the current output format.
+func Format() string {
+	return root.Load().format
+}
+
+// For returns the logger for the named subsystem. Records carry the name in
+// a "subsystem" attribute.
+func For(name string) *slog.Logger {
+	mu.Lock()
+	sub, ok := subsystems[name]
+	if !ok {
+		sub = &subsystem{name: name}
+		subsystems[name] = sub
+	}
+	mu.Unlock()
+
+	return slog.New(&handler{sub: sub})
+}
+
+// SetDebug enables or disables debug output for a subsystem regardless of
+// the global level.
+func SetDebug(name string, on bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	sub, ok := subsystems[name]
+	if !ok {
+		return fmt.Errorf("unknown log subsystem: %s (known: %s)", name, strings.Join(names(), ", "))
+	}
+	sub.debug.Store(on)
+	return nil
+}
+
+// Subsystems reports every known subsystem and whether its debug output is
+// enabled.
+func Subsystems() map[string]bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	result := make(map[string]bool, len(subsystems))
+	for name, sub := range subsystems {
+		result[name] = sub.debug.Load()
+	}
+	return result
+}
+
+// names returns the sorted subsystem names; mu must be held.
+func names() []string {
+	list := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+type subsystem struct {
+	name  string
+	debug atomic.Bool
+}
+
+// handler filters by level for its subsystem and forwards to whichever root
+// handler is current, so loggers created before Setup still follow it.
+type handler struct {
+	sub *subsystem
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	if l >= level.Level() {
+		return true
+	}
+	return l >= slog.LevelDebug && h.sub.debug.Load()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := root.Load().handler.WithAttrs([]slog.Attr{slog.String("subsystem", h.sub.name)})
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{sub: h.sub, ops: append(ops, op)}
+}
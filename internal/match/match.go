@@ -0,0 +1,53 @@
+package match
+
+import "strings"
+
+// Glob reports whether s matches pattern. Only a leading and/or trailing "*"
+// is special; a pattern without wildcards matches as a substring.
+func Glob(s, pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*") {
+		return strings.Contains(s, pattern[1:len(pattern)-1])
+	}
+
+	if strings.HasPrefix(pattern, "*") {
+		return strings.HasSuffix(s, pattern[1:])
+	}
+
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(s, pattern[:len(pattern)-1])
+	}
+
+	return strings.Contains(s, pattern)
+}
+
+// Wildcard reports whether all of s matches pattern, where "*" matches any
+// run of characters, including "/", and "?" matches exactly one character.
+func Wildcard(s, pattern string) bool {
+	// Iterative matching with backtracking to the last "*".
+	var si, pi int
+	star, mark := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(pattern) && (pattern[pi] == '?' || pattern[pi] == s[si]):
+			si++
+			pi++
+		case pi < len(pattern) && pattern[pi] == '*':
+			star, mark = pi, si
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			si = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(pattern) && pattern[pi] == '*' {
+		pi++
+	}
+	return pi == len(pattern)
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cascade/internal/config"
+)
+
+// ACL decides which clients may use the proxy, and for which destinations.
+// The first matching rule wins. Without rules every client is allowed; with
+// rules, a request that matches none is denied.
+type ACL struct {
+	rules        []*aclRule
+	connectPorts []int
+}
+
+type aclRule struct {
+	desc    string
+	allow   bool
+	clients []*net.IPNet
+	hosts   []string
+	ports   []int
+	methods []string
+	users   []string
+}
+
+// access is what an ACL rule is matched against.
+type access struct {
+	client net.IP
+	user   string
+	method string
+	host   string
+	port   int
+}
+
+func NewACL(rules []config.ACLRule, connectPorts []int) (*ACL, error) {
+	a := &ACL{connectPorts: connectPorts}
+	for i, rc := range rules {
+		r := &aclRule{
+			desc:    fmt.Sprintf("acl[%d]", i),
+			allow:   rc.Action == config.ACLAllow,
+			hosts:   lowerAll(rc.Hosts),
+			ports:   rc.Ports,
+			methods: rc.Methods,
+			users:   rc.Users,
+		}
+		if rc.Name != "" {
+			r.desc += " (" + rc.Name + ")"
+		}
+		for _, client := range rc.Clients {
+			network, err := config.ParseNetwork(client)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.desc, err)
+			}
+			r.clients = append(r.clients, network)
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+func (r *aclRule) matches(req access) bool {
+	return r.matchesAnyUser(req) && (len(r.users) == 0 || matchUser(req.user, r.users))
+}
+
+// matchesAnyUser reports whether r matches req apart from its users.
+func (r *aclRule) matchesAnyUser(req access) bool {
+	if len(r.clients) > 0 && !containsIP(r.clients, req.client) {
+		return false
+	}
+	if len(r.hosts) > 0 && !anyWildcard(strings.ToLower(req.host), r.hosts) {
+		return false
+	}
+	if len(r.ports) > 0 && !containsInt(r.ports, req.port) {
+		return false
+	}
+	if len(r.methods) > 0 && !anyEqualFold(req.method, r.methods) {
+		return false
+	}
+	return true
+}
+
+// check reports whether the request is allowed and what decided it.
+func (a *ACL) check(req access) (bool, string) {
+	if req.method == http.MethodConnect && !containsInt(a.connectPorts, req.port) {
+		return false, "server.connect_ports"
+	}
+	for _, r := range a.rules {
+		if r.matches(req) {
+			return r.allow, r.desc
+		}
+	}
+	if len(a.rules) > 0 {
+		return false, "no acl rule"
+	}
+	return true, ""
+}
+
+// deniesEveryone reports whether the request is denied whichever user, if
+// any, makes it, and what decided it. It is checked before authentication,
+// so that a client the ACL turns away is not asked for credentials.
+func (a *ACL) deniesEveryone(req access) (bool, string) {
+	if req.method == http.MethodConnect && !containsInt(a.connectPorts, req.port) {
+		return true, "server.connect_ports"
+	}
+	for _, r := range a.rules {
+		if !r.matchesAnyUser(req) {
+			continue
+		}
+		if len(r.users) == 0 {
+			return !r.allow, r.desc
+		}
+		if r.allow {
+			// Some user may be allowed.
+			return false, ""
+		}
+	}
+	if len(a.rules) > 0 {
+		return true, "no acl rule"
+	}
+	return false, ""
+}
+
+// newAccess describes r from user for the ACL: the client address and the
+// destination host and port, defaulting the port from the scheme.
+func newAccess(r *http.Request, user string) access {
+	req := access{method: r.Method, user: user}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.client = net.ParseIP(host)
+	}
+
+	hostport, scheme := r.URL.Host, r.URL.Scheme
+	if r.Method == http.MethodConnect || hostport == "" {
+		hostport = r.Host
+	}
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil || r.Method == http.MethodConnect {
+			scheme = "https"
+		}
+	}
+
+	req.host = strings.Trim(hostport, "[]")
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		req.host = host
+		req.port, _ = strconv.Atoi(port)
+	} else if scheme == "https" {
+		req.port = 443
+	} else {
+		req.port = 80
+	}
+	return req
+}
+
+// matchUser reports whether user is in users; "*" stands for any
+// authenticated user.
+func matchUser(user string, users []string) bool {
+	if user == "" {
+		return false
+	}
+	for _, u := range users {
+		if u == "*" || u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
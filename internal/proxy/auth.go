@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"cascade/internal/config"
+)
+
+// authenticator checks Proxy-Authorization against static users, an
+// htpasswd file and bearer tokens, in that order.
+type authenticator struct {
+	realm    string
+	optional bool
+	users    map[string]string
+	tokens   map[string]string
+	htpasswd *htpasswd
+}
+
+// newAuthenticator returns nil when no authentication is configured.
+func newAuthenticator(cfg config.AuthConfig) (*authenticator, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	a := &authenticator{
+		realm:    cfg.Realm,
+		optional: cfg.Optional,
+		users:    cfg.Users,
+		tokens:   cfg.Tokens,
+	}
+	if cfg.Htpasswd != "" {
+		h, err := loadHtpasswd(cfg.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		a.htpasswd = h
+	}
+	return a, nil
+}
+
+// authenticate returns the user r authenticates as, or "" for an anonymous
+// request. ok is false if the request has to be challenged: its credentials
+// are wrong, or it has none and authentication is required.
+func (a *authenticator) authenticate(r *http.Request) (user string, ok bool) {
+	if a == nil {
+		return "", true
+	}
+
+	header := r.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", a.optional
+	}
+
+	scheme, credentials, _ := strings.Cut(header, " ")
+	credentials = strings.TrimSpace(credentials)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", false
+		}
+		user, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			return "", false
+		}
+		return user, a.checkPassword(user, password)
+	case "bearer":
+		return a.checkToken(credentials)
+	}
+	return "", false
+}
+
+func (a *authenticator) checkPassword(user, password string) bool {
+	if want, ok := a.users[user]; ok {
+		return secureEqual(password, want)
+	}
+	if a.htpasswd != nil {
+		return a.htpasswd.check(user, password)
+	}
+	return false
+}
+
+// checkToken compares token with every configured token, so the time taken
+// does not reveal which one came close.
+func (a *authenticator) checkToken(token string) (string, bool) {
+	found := ""
+	for user, want := range a.tokens {
+		if secureEqual(token, want) {
+			found = user
+		}
+	}
+	return found, found != "" && token != ""
+}
+
+// challenge replies 407 with a Proxy-Authenticate header for each scheme
+// that can succeed.
+func (a *authenticator) challenge(w http.ResponseWriter) {
+	if len(a.users) > 0 || a.htpasswd != nil {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+	}
+	if len(a.tokens) > 0 {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm))
+	}
+	setOutcome(w, outcomeDenied)
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.errMsg = "proxy authentication required"
+	}
+	writePage(w, http.StatusProxyAuthRequired, "Proxy authentication required",
+		"This proxy requires a user name and password or a token", "")
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// htpasswdCheckInterval limits how often the htpasswd file is checked for
+// changes.
+const htpasswdCheckInterval = time.Second
+
+// htpasswd holds the bcrypt hashes from an htpasswd file and re-reads the
+// file when it changes. Passwords that have been verified are remembered by
+// their SHA-256, as bcrypt is deliberately slow and clients authenticate
+// every request.
+type htpasswd struct {
+	path string
+
+	mu       sync.Mutex
+	hashes   map[string][]byte
+	verified map[string][sha256.Size]byte
+	modTime  time.Time
+	size     int64
+	checked  time.Time
+}
+
+func loadHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the file; h.mu must be held or h not yet shared.
+func (h *htpasswd) load() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			logger.Warn("skipping malformed htpasswd line", "file", h.path, "line", n)
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			logger.Warn("skipping htpasswd entry without a bcrypt hash", "file", h.path, "line", n, "user", user)
+			continue
+		}
+		hashes[user] = []byte(hash)
+	}
+
+	h.hashes = hashes
+	h.verified = make(map[string][sha256.Size]byte)
+	h.modTime, h.size = info.ModTime(), info.Size()
+	h.checked = time.Now()
+	return nil
+}
+
+// refresh re-reads the file if it has changed; h.mu must be held. A file
+// that cannot be read leaves the current users in place.
+func (h *htpasswd) refresh() {
+	if time.Since(h.checked) < htpasswdCheckInterval {
+		return
+	}
+	h.checked = time.Now()
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		logger.Error("failed to check htpasswd file, keeping the loaded users", "file", h.path, "err", err)
+		return
+	}
+	if info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return
+	}
+	if err := h.load(); err != nil {
+		logger.Error("failed to reload htpasswd file, keeping the loaded users", "file", h.path, "err", err)
+		return
+	}
+	logger.Info("reloaded htpasswd file", "file", h.path, "users", len(h.hashes))
+}
+
+func (h *htpasswd) check(user, password string) bool {
+	sum := sha256.Sum256([]byte(user + ":" + password))
+
+	h.mu.Lock()
+	h.refresh()
+	hash, ok := h.hashes[user]
+	known, verified := h.verified[user]
+	h.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	if verified && subtle.ConstantTimeCompare(known[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	h.mu.Lock()
+	// The file may have been reloaded meanwhile; only remember the
+	// password if the hash it was checked against is still current.
+	if bytes.Equal(h.hashes[user], hash) {
+		h.verified[user] = sum
+	}
+	h.mu.Unlock()
+	return true
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cascade/internal/cache"
+)
+
+// cacheName identifies this cache in Cache-Status field values.
+const cacheName = "Cascade"
+
+// Forward reasons used in Cache-Status (RFC 9211, section 2.2).
+const (
+	fwdBypass  = "bypass"
+	fwdMethod  = "method"
+	fwdURIMiss = "uri-miss"
+	fwdMiss    = "miss"
+	fwdStale   = "stale"
+)
+
+// cacheStatus describes how Cascade handled a request, rendered as an RFC 9211
+// Cache-Status field value. An empty fwd means the response was a hit.
+type cacheStatus struct {
+	fwd       string
+	fwdStatus int
+	ttl       time.Duration
+	stored    bool
+	detail    string
+}
+
+func (c cacheStatus) String() string {
+	params := []string{cacheName}
+	if c.fwd == "" {
+		params = append(params, "hit")
+	} else {
+		params = append(params, "fwd="+c.fwd)
+		if c.fwdStatus != 0 {
+			params = append(params, "fwd-status="+strconv.Itoa(c.fwdStatus))
+		}
+	}
+	if c.fwd == "" || c.stored {
+		params = append(params, "ttl="+strconv.FormatInt(int64(c.ttl/time.Second), 10))
+	}
+	if c.stored {
+		params = append(params, "stored")
+	}
+	if c.detail != "" {
+		params = append(params, "detail="+strconv.Quote(c.detail))
+	}
+	return strings.Join(params, "; ")
+}
+
+// fwdReason maps the error from a cache lookup onto a Cache-Status forward
+// reason.
+func fwdReason(err error) string {
+	switch {
+	case errors.Is(err, cache.ErrNotFound):
+		return fwdURIMiss
+	case errors.Is(err, cache.ErrExpired):
+		return fwdStale
+	}
+	return fwdMiss
+}
+
+// age returns the Age of a cached response: the Age the origin reported when
+// it was stored plus the time it has been resident in the cache.
+func age(entry *cache.CacheEntry) time.Duration {
+	resident := time.Since(entry.CreatedAt)
+	if upstream, err := strconv.ParseInt(entry.Headers["Age"], 10, 64); err == nil && upstream > 0 {
+		resident += time.Duration(upstream) * time.Second
+	}
+	if resident < 0 {
+		return 0
+	}
+	return resident
+}
+
+// setDebugHeaders exposes the cache key, the rule that decided how the
+// request was handled and the remaining TTL, if server.debug_headers is set.
+// A negative ttl is omitted.
+func (s *settings) setDebugHeaders(h http.Header, targetURL, rule string, ttl time.Duration) {
+	if !s.config.Server.DebugHeaders {
+		return
+	}
+	h.Set("X-Cascade-Key", cache.Key(targetURL))
+	if rule != "" {
+		h.Set("X-Cascade-Rule", rule)
+	}
+	if ttl >= 0 {
+		h.Set("X-Cascade-TTL", strconv.FormatInt(int64(ttl/time.Second), 10))
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"cascade/internal/config"
+)
+
+// blockedByDefault are the ranges a forward proxy should not reach on a
+// client's behalf: this host, private networks, link-local addresses such as
+// cloud metadata services, and other special-purpose ranges.
+var blockedByDefault = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// DestinationPolicy decides which addresses may be dialed upstream. It is
+// checked against the address actually connected to, after DNS resolution,
+// so a name that resolves, or later re-resolves, to a blocked address cannot
+// be used to reach it.
+type DestinationPolicy struct {
+	allow            []*net.IPNet
+	deny             []*net.IPNet
+	defaults         []*net.IPNet
+	resolveViaEgress bool
+}
+
+// BlockedError is returned for a dial to an address the policy blocks.
+type BlockedError struct {
+	IP   net.IP
+	Rule string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("destination %s is blocked by %s", e.IP, e.Rule)
+}
+
+func NewDestinationPolicy(cfg config.DestinationsConfig) (*DestinationPolicy, error) {
+	d := &DestinationPolicy{resolveViaEgress: cfg.ResolveViaEgress}
+	var err error
+	if d.allow, err = parseNetworks(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("destinations.allow: %w", err)
+	}
+	if d.deny, err = parseNetworks(cfg.Deny); err != nil {
+		return nil, fmt.Errorf("destinations.deny: %w", err)
+	}
+	if d.defaults, err = parseNetworks(blockedByDefault); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		network, err := config.ParseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// check returns a *BlockedError if ip may not be dialed.
+func (d *DestinationPolicy) check(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if network := findNetwork(d.deny, ip); network != nil {
+		return &BlockedError{IP: ip, Rule: "destinations.deny " + network.String()}
+	}
+	if findNetwork(d.allow, ip) != nil {
+		return nil
+	}
+	if network := findNetwork(d.defaults, ip); network != nil {
+		return &BlockedError{IP: ip, Rule: "blocked range " + network.String()}
+	}
+	return nil
+}
+
+// control is a net.Dialer Control function that refuses blocked addresses
+// just before connecting.
+func (d *DestinationPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected dial address %q", address)
+	}
+	return d.check(ip)
+}
+
+// resolve returns addr with the host replaced by the first allowed address
+// it resolves to, for dialing through an egress proxy, which would
+// otherwise resolve the name itself. A name that does not resolve here
+// cannot be checked and is refused, unless resolve_via_egress passes it on
+// for the egress proxy to resolve.
+func (d *DestinationPolicy) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addr, d.check(ip)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses")
+	}
+	if err != nil {
+		if d.resolveViaEgress {
+			logger.Debug("leaving name resolution to the egress proxy", "host", host, "err", err)
+			return addr, nil
+		}
+		return "", fmt.Errorf("cannot check %s against the destination policy: %w", host, err)
+	}
+	var blocked error
+	for _, a := range addrs {
+		if err := d.check(a.IP); err != nil {
+			blocked = err
+			continue
+		}
+		return net.JoinHostPort(a.IP.String(), port), nil
+	}
+	return "", blocked
+}
+
+func findNetwork(networks []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
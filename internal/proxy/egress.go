@@ -3,28 +3,83 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
+	"cascade/internal/tracing"
+
 	"golang.org/x/net/proxy"
 )
 
+// EgressDialer makes every upstream connection, directly or through the
+// configured egress proxy, subject to the destination policy.
 type EgressDialer struct {
 	proxyType string
 	proxyURL  string
 	dialer    proxy.Dialer
+	policy    *DestinationPolicy
+
+	healthMu sync.Mutex
+	health   EgressHealth
+}
+
+// EgressHealth summarises recent upstream connection attempts through the
+// egress path.
+type EgressHealth struct {
+	Type                string    `json:"type"`
+	Proxy               string    `json:"proxy,omitempty"`
+	Dials               int64     `json:"dials"`
+	Failures            int64     `json:"failures"`
+	ConsecutiveFailures int64     `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// Health reports the outcome of dials made so far.
+func (e *EgressDialer) Health() EgressHealth {
+	e.healthMu.Lock()
+	defer e.healthMu.Unlock()
+
+	h := e.health
+	h.Type = "direct"
+	if e.proxyType != "" {
+		h.Type = e.proxyType
+		h.Proxy = redactURL(e.proxyURL)
+	}
+	return h
+}
+
+func (e *EgressDialer) recordDial(err error) {
+	e.healthMu.Lock()
+	defer e.healthMu.Unlock()
+
+	e.health.Dials++
+	if err != nil {
+		e.health.Failures++
+		e.health.ConsecutiveFailures++
+		e.health.LastFailure = time.Now()
+		e.health.LastError = err.Error()
+		return
+	}
+	e.health.ConsecutiveFailures = 0
+	e.health.LastSuccess = time.Now()
 }
 
-func NewEgressDialer(proxyType, proxyURL string) (*EgressDialer, error) {
+func NewEgressDialer(proxyType, proxyURL string, policy *DestinationPolicy) (*EgressDialer, error) {
 	if proxyType == "" || proxyURL == "" {
 		return &EgressDialer{
 			dialer: &net.Dialer{
 				Timeout:   30 * time.Second,
 				KeepAlive: 30 * time.Second,
+				Control:   policy.control,
 			},
+			policy: policy,
 		}, nil
 	}
 
@@ -73,17 +128,49 @@ func NewEgressDialer(proxyType, proxyURL string) (*EgressDialer, error) {
 		proxyType: proxyType,
 		proxyURL:  proxyURL,
 		dialer:    dialer,
+		policy:    policy,
 	}, nil
 }
 
+// DialContext connects to addr. Direct connections are checked against the
+// destination policy as they are made; through an egress proxy, addr is
+// resolved and checked here and the proxy is given the address.
+func (e *EgressDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, span := tracing.Start(ctx, "upstream.dial", tracing.KindInternal)
+	defer span.End()
+	span.Set("server.address", addr)
+	if e.proxyType != "" {
+		span.Set("cascade.egress.type", e.proxyType)
+	}
+
+	var conn net.Conn
+	var err error
+	if e.proxyType != "" {
+		addr, err = e.policy.resolve(ctx, addr)
+	}
+	if err == nil {
+		if cd, ok := e.dialer.(proxy.ContextDialer); ok {
+			conn, err = cd.DialContext(ctx, network, addr)
+		} else {
+			conn, err = e.dialer.Dial(network, addr)
+		}
+	}
+
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		// A refused destination says nothing about the egress path.
+		e.recordDial(err)
+	}
+	span.Fail(err)
+	return conn, err
+}
+
 func (e *EgressDialer) GetTransport() *http.Transport {
 	return &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return e.dialer.Dial(network, addr)
-		},
+		DialContext:           e.DialContext,
 		MaxIdleConns:          1000,
 		MaxIdleConnsPerHost:   100,
-		MaxConnsPerHost:       100,
+		MaxConnsPerHost:       0,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
@@ -100,10 +187,19 @@ type httpProxyDialer struct {
 }
 
 func (h *httpProxyDialer) Dial(network, addr string) (net.Conn, error) {
-	conn, err := h.direct.Dial("tcp", h.proxyURL.Host)
+	return h.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the proxy; ctx bounds both the
+// connection to the proxy and the CONNECT exchange.
+func (h *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := h.direct.DialContext(ctx, "tcp", h.proxyURL.Host)
 	if err != nil {
 		return nil, err
 	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
 
 	req := &http.Request{
 		Method: "CONNECT",
@@ -135,5 +231,10 @@ func (h *httpProxyDialer) Dial(network, addr string) (net.Conn, error) {
 		return nil, fmt.Errorf("CONNECT failed with status %d: %s", resp.StatusCode, resp.Status)
 	}
 
+	if !stop() {
+		// ctx ended during the exchange and the deadline may already be set.
+		conn.Close()
+		return nil, ctx.Err()
+	}
 	return conn, nil
 }
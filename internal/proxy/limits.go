@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+
+	"cascade/internal/config"
+	"cascade/internal/ratelimit"
+)
+
+// Traffic classes with separate per-client limits.
+const (
+	classHit  = "hit"
+	classMiss = "miss"
+)
+
+// limits enforces the limits section: per-client request rates and
+// bandwidth for cache hits and misses, and a cap on upstream bandwidth.
+type limits struct {
+	byUser   bool
+	requests map[string]*ratelimit.Keyed
+	bytes    map[string]*ratelimit.Keyed
+	upstream *ratelimit.Bucket
+}
+
+func newLimits(cfg config.LimitsConfig) *limits {
+	l := &limits{
+		byUser:   cfg.Key == config.LimitKeyUser,
+		requests: make(map[string]*ratelimit.Keyed),
+		bytes:    make(map[string]*ratelimit.Keyed),
+		upstream: byteBucket(cfg.UpstreamBytesPerSecond),
+	}
+	for class, c := range map[string]config.ClientLimits{classHit: cfg.Hit, classMiss: cfg.Miss} {
+		l.requests[class] = ratelimit.NewKeyed(c.RequestsPerSecond, c.Burst)
+		l.bytes[class] = ratelimit.NewKeyed(float64(c.BytesPerSecond), byteBurst(c.BytesPerSecond))
+	}
+	return l
+}
+
+// byteBurst lets a bandwidth limit pass a second's worth of data at once.
+func byteBurst(rate config.ByteSize) int {
+	return int(min(int64(rate), math.MaxInt32))
+}
+
+func byteBucket(rate config.ByteSize) *ratelimit.Bucket {
+	return ratelimit.NewBucket(float64(rate), byteBurst(rate))
+}
+
+// key returns what the client's limits are counted against.
+func (l *limits) key(w http.ResponseWriter, r *http.Request) string {
+	if rr, ok := w.(*responseRecorder); ok && l.byUser && rr.user != "" {
+		return "user:" + rr.user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// admit takes a request token for the client in class. If none is left it
+// replies 429 and returns false.
+func (l *limits) admit(w http.ResponseWriter, r *http.Request, class string) bool {
+	key := l.key(w, r)
+	ok, wait := l.requests[class].Get(key).Allow()
+	if ok {
+		return true
+	}
+	setting := "limits." + class + ".requests_per_second"
+	logger.Info("request rate limited", "client", r.RemoteAddr, "key", key, "method", r.Method, "limit", setting)
+	setOutcome(w, outcomeLimited)
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.errMsg = "rate limited by " + setting
+	}
+	w.Header().Set("Retry-After", retryAfter(wait))
+	writePage(w, http.StatusTooManyRequests, "Too many requests",
+		"Too many requests from this client, try again later", "")
+	return false
+}
+
+// writer throttles dst, which carries the response to r, to the client's
+// bandwidth limit for class and, as misses come from upstream, to the
+// upstream cap.
+func (l *limits) writer(dst io.Writer, w http.ResponseWriter, r *http.Request, class string) io.Writer {
+	buckets := []*ratelimit.Bucket{l.bytes[class].Get(l.key(w, r))}
+	if class == classMiss {
+		buckets = append(buckets, l.upstream)
+	}
+	return ratelimit.Writer(r.Context(), dst, buckets...)
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cascade/internal/config"
+	"cascade/internal/match"
+	"cascade/internal/metrics"
+)
+
+// Request outcomes, used as the outcome label and in logs.
+const (
+	outcomeHit         = "hit"
+	outcomeStale       = "stale"
+	outcomeMiss        = "miss"
+	outcomePassthrough = "passthrough"
+	outcomeConnect     = "connect"
+	outcomeDenied      = "denied"
+	outcomeLimited     = "limited"
+	outcomeError       = "error"
+)
+
+// otherHostGroup labels hosts that match no configured host group.
+const otherHostGroup = "other"
+
+var (
+	requestsTotal = metrics.Default.NewCounterVec(
+		"cascade_requests_total",
+		"Proxy requests by outcome.",
+		"outcome", "host_group")
+	responseBytesTotal = metrics.Default.NewCounterVec(
+		"cascade_response_bytes_total",
+		"Response body bytes sent to clients, by where they came from.",
+		"source", "host_group")
+	upstreamDurationSeconds = metrics.Default.NewHistogramVec(
+		"cascade_upstream_request_duration_seconds",
+		"Time from sending an upstream request until its response headers arrive.",
+		metrics.DefBuckets,
+		"host_group")
+	inflightDownloads = metrics.Default.NewGauge(
+		"cascade_inflight_downloads",
+		"Upstream downloads currently being streamed into the cache.")
+)
+
+// hostGroups maps hosts onto a bounded set of metric label values.
+type hostGroups []config.HostGroupConfig
+
+func (g hostGroups) group(host string) string {
+	host = strings.ToLower(host)
+	for _, hg := range g {
+		for _, pattern := range hg.Hosts {
+			if match.Wildcard(host, strings.ToLower(pattern)) {
+				return hg.Name
+			}
+		}
+	}
+	return otherHostGroup
+}
+
+// responseRecorder wraps the client's ResponseWriter to capture what the
+// proxy sent, for metrics and the access log.
+type responseRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	outcome      string
+	upstreamHost string
+	upstreamTime time.Duration
+	errMsg       string
+	user         string
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+	return h.Hijack()
+}
+
+// setOutcome records how the request was handled, if w is a recorder.
+func setOutcome(w http.ResponseWriter, outcome string) {
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.outcome = outcome
+	}
+}
+
+// setStatus records a status written around the recorder, such as the
+// "200 Connection Established" sent on a hijacked CONNECT connection.
+func setStatus(w http.ResponseWriter, status int) {
+	if rr, ok := w.(*responseRecorder); ok && rr.status == 0 {
+		rr.status = status
+	}
+}
+
+// addBytes accounts for body bytes written around the recorder, such as
+// tunnelled CONNECT traffic.
+func addBytes(w http.ResponseWriter, n int64) {
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.bytes += n
+	}
+}
+
+// addUpstream records which origin served the request and how long it took
+// to respond.
+func addUpstream(w http.ResponseWriter, host string, d time.Duration) {
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.upstreamHost = host
+		rr.upstreamTime += d
+	}
+}
+
+// setUser records the authenticated user.
+func setUser(w http.ResponseWriter, user string) {
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.user = user
+	}
+}
+
+// setError records the cause of a failure in more detail than the message
+// sent to the client.
+func setError(w http.ResponseWriter, err error) {
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.errMsg = err.Error()
+	}
+}
+
+// fail replies with an error generated by the proxy itself.
+func fail(w http.ResponseWriter, msg string, status int) {
+	setOutcome(w, outcomeError)
+	if rr, ok := w.(*responseRecorder); ok && rr.errMsg == "" {
+		rr.errMsg = msg
+	}
+	http.Error(w, msg, status)
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}}</title></head>
+<body>
+<h1>{{.Heading}}</h1>
+<p>{{.Message}}.</p>
+{{- if .Rule}}
+<p>Denied by: {{.Rule}}</p>
+{{- end}}
+<hr><address>Cascade</address>
+</body>
+</html>
+`))
+
+// writePage replies with an HTML page explaining why the proxy refused a
+// request.
+func writePage(w http.ResponseWriter, status int, heading, msg, rule string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	errorPage.Execute(w, struct{ Status, Heading, Message, Rule string }{
+		fmt.Sprintf("%d %s", status, http.StatusText(status)), heading, msg, rule,
+	})
+}
+
+// upstreamFailed replies to a request whose upstream connection failed:
+// 403 if the destination policy refused the address, 503 if the origin's
+// circuit breaker is open or its connection slots stayed busy, else 502 with
+// msg.
+func upstreamFailed(w http.ResponseWriter, err error, msg string) {
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		deny(w, "The destination address is not allowed", blocked.Rule)
+		return
+	}
+	setError(w, err)
+	var open *BreakerOpenError
+	var queued *QueueTimeoutError
+	switch {
+	case errors.As(err, &open):
+		w.Header().Set("Retry-After", retryAfter(time.Until(open.Until)))
+		fail(w, "The origin server is failing and is not being contacted for now", http.StatusServiceUnavailable)
+	case errors.As(err, &queued):
+		fail(w, "Too many requests to the origin server are in progress", http.StatusServiceUnavailable)
+	default:
+		fail(w, msg, http.StatusBadGateway)
+	}
+}
+
+// retryAfter formats d as a Retry-After value in whole seconds, at least 1.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
+
+// deny refuses a request because of rule with a page naming the rule.
+func deny(w http.ResponseWriter, msg, rule string) {
+	setOutcome(w, outcomeDenied)
+	if rr, ok := w.(*responseRecorder); ok {
+		rr.errMsg = "denied by " + rule
+	}
+	writePage(w, http.StatusForbidden, "Access denied", msg, rule)
+}
+
+func (p *Proxy) observe(s *settings, rr *responseRecorder, host string) {
+	group := s.hostGroups.group(host)
+	requestsTotal.WithLabelValues(rr.outcome, group).Inc()
+
+	source := "upstream"
+	switch rr.outcome {
+	case outcomeHit, outcomeStale:
+		source = "cache"
+	case outcomeError:
+		return
+	}
+	responseBytesTotal.WithLabelValues(source, group).Add(float64(rr.bytes))
+}
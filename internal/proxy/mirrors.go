@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cascade/internal/config"
+	"cascade/internal/metrics"
+)
+
+var (
+	mirrorRequestsTotal = metrics.Default.NewCounterVec(
+		"cascade_mirror_requests_total",
+		"Requests to pool mirrors, by result: ok, error (connection error or 5xx) or truncated.",
+		"pool", "mirror", "result")
+	mirrorLatencySeconds = metrics.Default.NewGaugeVec(
+		"cascade_mirror_latency_seconds",
+		"Moving average of the time pool mirrors take to send response headers.",
+		"pool", "mirror")
+)
+
+// mirrorBackoff is how long a mirror that failed is tried after the others.
+const mirrorBackoff = time.Minute
+
+// latencyWeight is the weight of the newest sample in a mirror's moving
+// average latency.
+const latencyWeight = 0.3
+
+// mirrorPools maps request URLs onto the mirror pools they belong to.
+type mirrorPools map[string]*mirrorPool
+
+type mirrorPool struct {
+	name    string
+	order   bool
+	mirrors []*mirror
+}
+
+type mirror struct {
+	pool  string
+	base  string
+	label string
+
+	mu          sync.Mutex
+	latency     time.Duration
+	lastFailure time.Time
+}
+
+func newMirrorPools(cfg []config.MirrorPool) mirrorPools {
+	pools := make(mirrorPools)
+	for _, c := range cfg {
+		pool := &mirrorPool{name: c.Name, order: c.Select == config.MirrorSelectOrder}
+		for _, raw := range c.URLs {
+			pool.mirrors = append(pool.mirrors, &mirror{
+				pool:  c.Name,
+				base:  strings.TrimSuffix(raw, "/"),
+				label: redactURL(raw),
+			})
+		}
+		pools[c.Name] = pool
+	}
+	return pools
+}
+
+// resolve returns the cache key for targetURL, mirror://<pool>/<path> if it
+// is under a pool's mirror or addresses the pool by name, and the URL to
+// handle the request as: targetURL itself, or for a pool name or mirror://
+// key the first mirror's URL.
+func (m mirrorPools) resolve(targetURL string) (key, target string) {
+	if _, _, ok := m.lookup(targetURL); ok {
+		return targetURL, m.ruleURL(targetURL)
+	}
+	if u, err := url.Parse(targetURL); err == nil && u.Scheme == "http" {
+		if pool, ok := m[strings.ToLower(u.Hostname())]; ok {
+			key = pool.key(u.RequestURI())
+			return key, pool.mirrors[0].url(u.RequestURI())
+		}
+	}
+	for _, pool := range m {
+		for _, mr := range pool.mirrors {
+			if rest, ok := strings.CutPrefix(targetURL, mr.base); ok && (rest == "" || rest[0] == '/' || rest[0] == '?') {
+				return pool.key(rest), targetURL
+			}
+		}
+	}
+	return targetURL, targetURL
+}
+
+// lookup returns the pool and path a mirror:// cache key refers to.
+func (m mirrorPools) lookup(key string) (*mirrorPool, string, bool) {
+	rest, ok := strings.CutPrefix(key, config.MirrorScheme+"://")
+	if !ok {
+		return nil, "", false
+	}
+	name, path, _ := strings.Cut(rest, "/")
+	return m[name], "/" + path, true
+}
+
+// ruleURL returns the URL the rules see for key: the first mirror's URL for
+// a mirror:// key, else key itself.
+func (m mirrorPools) ruleURL(key string) string {
+	if pool, path, ok := m.lookup(key); ok && pool != nil {
+		return pool.mirrors[0].url(path)
+	}
+	return key
+}
+
+func (p *mirrorPool) key(path string) string {
+	if path == "" || path[0] != '/' {
+		path = "/" + path
+	}
+	return config.MirrorScheme + "://" + p.name + path
+}
+
+// candidates returns the pool's mirrors in the order to try them: those
+// that have not failed recently first, by latency or as listed, then the
+// others, least recently failed first.
+func (p *mirrorPool) candidates() []*mirror {
+	type candidate struct {
+		m           *mirror
+		latency     time.Duration
+		lastFailure time.Time
+		failed      bool
+	}
+	now := time.Now()
+	list := make([]candidate, len(p.mirrors))
+	for i, m := range p.mirrors {
+		m.mu.Lock()
+		list[i] = candidate{m, m.latency, m.lastFailure, now.Sub(m.lastFailure) < mirrorBackoff}
+		m.mu.Unlock()
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.failed != b.failed {
+			return !a.failed
+		}
+		if a.failed {
+			return a.lastFailure.Before(b.lastFailure)
+		}
+		// Unmeasured mirrors have no latency and are tried first.
+		return !p.order && a.latency < b.latency
+	})
+	mirrors := make([]*mirror, len(list))
+	for i, c := range list {
+		mirrors[i] = c.m
+	}
+	return mirrors
+}
+
+func (m *mirror) url(path string) string {
+	return m.base + path
+}
+
+func (m *mirror) succeeded(latency time.Duration) {
+	m.mu.Lock()
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(m.latency))
+	}
+	avg := m.latency
+	m.mu.Unlock()
+	mirrorRequestsTotal.WithLabelValues(m.pool, m.label, "ok").Inc()
+	mirrorLatencySeconds.WithLabelValues(m.pool, m.label).Set(avg.Seconds())
+}
+
+func (m *mirror) failed(result string) {
+	m.mu.Lock()
+	m.lastFailure = time.Now()
+	m.mu.Unlock()
+	mirrorRequestsTotal.WithLabelValues(m.pool, m.label, result).Inc()
+}
+
+// fetchMirror requests path from the pool's mirrors in turn until one
+// answers without a connection error or a 5xx status. If none does, the
+// last error or 5xx response is returned. resume, if not nil, fetches the
+// rest of a GET response body that ends early from the mirrors.
+func (p *Proxy) fetchMirror(s *settings, w http.ResponseWriter, r *http.Request, pool *mirrorPool, path string) (resp *http.Response, resume resumeFunc, err error) {
+	var lastResp *http.Response
+	var lastErr error
+	for i, m := range pool.candidates() {
+		if i > 0 {
+			logger.Info("failing over to the next mirror", "pool", pool.name, "mirror", m.label, "path", path)
+		}
+		req, err := newUpstreamRequest(r, r.Method, m.url(path))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		start := time.Now()
+		resp, err := p.doUpstream(s, w, req)
+		switch {
+		case err != nil:
+			m.failed("error")
+			logger.Warn("mirror failed", "pool", pool.name, "mirror", m.label, "err", err)
+			lastErr = err
+			continue
+		case resp.StatusCode >= 500:
+			m.failed("error")
+			logger.Warn("mirror failed", "pool", pool.name, "mirror", m.label, "status", resp.StatusCode)
+			if lastResp != nil {
+				lastResp.Body.Close()
+			}
+			lastResp, lastErr = resp, nil
+			continue
+		}
+		m.succeeded(time.Since(start))
+		if lastResp != nil {
+			lastResp.Body.Close()
+		}
+		if r.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+			if rs := p.newResumer(s, w, r, resp); rs != nil {
+				resume = rs.fromMirrors(pool, m, path)
+			}
+		}
+		return resp, resume, nil
+	}
+	if lastResp != nil {
+		return lastResp, nil, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("mirror pool %s has no mirrors", pool.name)
+	}
+	return nil, nil, lastErr
+}
+
+// fromMirrors returns a resumeFunc that fetches the rest of path, which
+// current stopped sending, from the pool's mirrors in turn. The mirror that
+// broke off has just failed, so it is tried last.
+func (rs *resumer) fromMirrors(pool *mirrorPool, current *mirror, path string) resumeFunc {
+	return func(offset int64) (io.ReadCloser, error) {
+		current.failed("truncated")
+		logger.Warn("mirror download truncated", "pool", pool.name, "mirror", current.label, "path", path, "offset", offset, "size", rs.size)
+
+		var lastErr error
+		for _, m := range pool.candidates() {
+			if rs.exhausted() {
+				break
+			}
+			start := time.Now()
+			body, err := rs.try(m.url(path), offset)
+			if err != nil {
+				m.failed("error")
+				logger.Warn("mirror failed to resume", "pool", pool.name, "mirror", m.label, "attempt", rs.attempts, "err", err)
+				lastErr = err
+				if rs.r.Context().Err() != nil {
+					break
+				}
+				continue
+			}
+			m.succeeded(time.Since(start))
+			logger.Info("resumed download from a mirror", "pool", pool.name, "mirror", m.label, "path", path, "offset", offset, "attempt", rs.attempts)
+			current = m
+			return body, nil
+		}
+		return nil, rs.giveUp(lastErr)
+	}
+}
+
+// newUpstreamRequest builds the request sent upstream for the client request
+// r, carrying r's headers and trace span.
+func newUpstreamRequest(r *http.Request, method, targetURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), method, targetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
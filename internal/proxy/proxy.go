@@ -1,63 +1,282 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"cascade/internal/accesslog"
 	"cascade/internal/cache"
 	"cascade/internal/config"
+	"cascade/internal/logging"
+	"cascade/internal/tracing"
 )
 
+var logger = logging.For("proxy")
+
 type Proxy struct {
-	config    *config.Config
+	settings  atomic.Pointer[settings]
 	storage   *cache.Storage
-	transport *http.Transport
-	rules     *Rules
-	client    *http.Client
+	accessLog *accesslog.Logger
+	stats     *stats
+}
+
+// settings is everything the proxy builds from its configuration. Reload
+// replaces it as a whole, so each lookup sees one consistent configuration.
+type settings struct {
+	config     *config.Config
+	auth       *authenticator
+	acl        *ACL
+	limits     *limits
+	mirrors    mirrorPools
+	upstreams  *upstreams
+	rules      *Rules
+	profiles   []config.Profile
+	hostGroups hostGroups
+	egress     *EgressDialer
+	transport  *http.Transport
+	client     *http.Client
 }
 
 func New(cfg *config.Config, storage *cache.Storage) (*Proxy, error) {
-	egressDialer, err := NewEgressDialer(
-		cfg.Egress.ProxyType,
-		cfg.Egress.ProxyURL,
-	)
+	s, err := newSettings(cfg, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create egress dialer: %w", err)
+		return nil, err
 	}
 
-	rules, err := NewRules(cfg.Rules.Passthrough, cfg.Rules.HTTPSPassthrough, cfg.Rules.SpecialTTL)
+	p := &Proxy{
+		storage: storage,
+		stats:   newStats(),
+	}
+	p.settings.Store(s)
+	return p, nil
+}
+
+// newSettings builds the settings for cfg. The egress dialer and its
+// connection pool are kept from old when the egress and destinations
+// configuration is the same.
+func newSettings(cfg *config.Config, old *settings) (*settings, error) {
+	profiles, err := cfg.Profiles.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve profiles: %w", err)
+	}
+	rules, err := NewRules(cfg.Rules, profiles)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create rules: %w", err)
 	}
+	auth, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := NewACL(cfg.ACL, cfg.Server.ConnectPorts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ACL: %w", err)
+	}
+
+	s := &settings{
+		config:     cfg,
+		auth:       auth,
+		acl:        acl,
+		rules:      rules,
+		profiles:   profiles,
+		hostGroups: hostGroups(cfg.Metrics.HostGroups),
+	}
+	// Keep the buckets, and what clients have used of them, unless the
+	// limits changed.
+	if old != nil && reflect.DeepEqual(old.config.Limits, cfg.Limits) {
+		s.limits = old.limits
+	} else {
+		s.limits = newLimits(cfg.Limits)
+	}
+	if old != nil && reflect.DeepEqual(old.config.Mirrors, cfg.Mirrors) {
+		s.mirrors = old.mirrors
+	} else {
+		s.mirrors = newMirrorPools(cfg.Mirrors)
+	}
+	if old != nil && reflect.DeepEqual(old.config.Upstreams, cfg.Upstreams) &&
+		reflect.DeepEqual(old.config.Metrics.HostGroups, cfg.Metrics.HostGroups) {
+		s.upstreams = old.upstreams
+	} else {
+		s.upstreams = newUpstreams(cfg.Upstreams, s.hostGroups.group)
+	}
+
+	if old != nil && old.config.Egress == cfg.Egress && reflect.DeepEqual(old.config.Destinations, cfg.Destinations) {
+		s.egress, s.transport, s.client = old.egress, old.transport, old.client
+		return s, nil
+	}
+
+	var proxyType, proxyURL string
+	if cfg.Egress.Enabled {
+		proxyType, proxyURL = cfg.Egress.ProxyType, cfg.Egress.ProxyURL
+	}
+	policy, err := NewDestinationPolicy(cfg.Destinations)
+	if err != nil {
+		return nil, err
+	}
+	s.egress, err = NewEgressDialer(proxyType, proxyURL, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create egress dialer: %w", err)
+	}
+
+	s.transport = s.egress.GetTransport()
+	s.transport.MaxIdleConns = 1000
+	s.transport.MaxIdleConnsPerHost = 100
+	s.transport.IdleConnTimeout = 90 * time.Second
+	s.transport.DisableCompression = false
+	s.transport.ForceAttemptHTTP2 = false
+
+	s.client = &http.Client{
+		Transport: s.transport,
+		Timeout:   5 * time.Minute,
+	}
+	return s, nil
+}
+
+func (p *Proxy) current() *settings {
+	return p.settings.Load()
+}
 
-	transport := egressDialer.GetTransport()
-	transport.MaxIdleConns = 1000
-	transport.MaxIdleConnsPerHost = 100
-	transport.MaxConnsPerHost = 100
-	transport.IdleConnTimeout = 90 * time.Second
-	transport.DisableCompression = false
-	transport.ForceAttemptHTTP2 = false
-
-	return &Proxy{
-		config:    cfg,
-		storage:   storage,
-		transport: transport,
-		rules:     rules,
-		client: &http.Client{
-			Transport: transport,
-			Timeout:   5 * time.Minute,
-		},
+// PrepareReload builds the settings for cfg without switching to them and
+// returns the function that does. Requests already running finish with the
+// settings they started with. If cfg cannot be applied the proxy keeps its
+// current settings.
+func (p *Proxy) PrepareReload(cfg *config.Config) (func(), error) {
+	old := p.current()
+	s, err := newSettings(cfg, old)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		p.settings.Store(s)
+		if s.transport != old.transport {
+			// Connections in use stay open until their requests finish.
+			old.transport.CloseIdleConnections()
+		}
+		if s.upstreams != old.upstreams {
+			old.upstreams.retire()
+		}
 	}, nil
 }
 
+// SetAccessLog makes the proxy write one access log record per request.
+func (p *Proxy) SetAccessLog(l *accesslog.Logger) {
+	p.accessLog = l
+}
+
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "proxy "+r.Method, tracing.KindServer)
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	s := p.current()
+	rr := &responseRecorder{ResponseWriter: w}
+	p.serve(s, rr, r)
+
+	span.Set("http.request.method", r.Method)
+	span.Set("url.full", r.URL.String())
+	span.Set("http.response.status_code", rr.status)
+	span.Set("cascade.outcome", rr.outcome)
+	span.Set("cascade.response.bytes", rr.bytes)
+	if rr.outcome == outcomeError {
+		span.Fail(fmt.Errorf("proxy error (status %d)", rr.status))
+	}
+
+	host := r.URL.Hostname()
+	if host == "" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	p.observe(s, rr, host)
+	p.stats.record(rr, r.Method, r.URL.String(), host)
+
+	if p.accessLog != nil {
+		p.accessLog.Log(p.accessRecord(rr, r, start))
+	}
+}
+
+func (p *Proxy) accessRecord(rr *responseRecorder, r *http.Request, start time.Time) *accesslog.Record {
+	clientIP := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = h
+	}
+
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		target = r.Host
+	}
+
+	return &accesslog.Record{
+		Time:         start,
+		ClientIP:     clientIP,
+		User:         rr.user,
+		Method:       r.Method,
+		URL:          target,
+		Proto:        r.Proto,
+		Status:       rr.status,
+		Bytes:        rr.bytes,
+		Duration:     time.Since(start),
+		Outcome:      rr.outcome,
+		UpstreamHost: rr.upstreamHost,
+		UpstreamTime: rr.upstreamTime,
+		ContentType:  rr.Header().Get("Content-Type"),
+		Referer:      r.Referer(),
+		UserAgent:    r.UserAgent(),
+	}
+}
+
+// serve handles r with s, the settings taken when it arrived, so a reload
+// in the middle of the request does not mix two configurations.
+func (p *Proxy) serve(s *settings, w http.ResponseWriter, r *http.Request) {
+	req := newAccess(r, "")
+	if denied, rule := s.acl.deniesEveryone(req); denied {
+		logger.Info("request denied", "client", r.RemoteAddr, "method", r.Method,
+			"host", req.host, "port", req.port, "rule", rule)
+		deny(w, "Access denied by the proxy's access control rules", rule)
+		return
+	}
+
+	user, ok := s.auth.authenticate(r)
+	if !ok {
+		if r.Header.Get("Proxy-Authorization") == "" {
+			// Clients send credentials only once challenged.
+			logger.Debug("proxy authentication required", "client", r.RemoteAddr, "method", r.Method)
+		} else {
+			logger.Info("proxy authentication failed", "client", r.RemoteAddr, "method", r.Method, "user", user)
+		}
+		s.auth.challenge(w)
+		return
+	}
+	setUser(w, user)
+	// The credentials are for this proxy only.
+	r.Header.Del("Proxy-Authorization")
+
+	req.user = user
+	if allowed, rule := s.acl.check(req); !allowed {
+		logger.Info("request denied", "client", r.RemoteAddr, "user", user, "method", r.Method,
+			"host", req.host, "port", req.port, "rule", rule)
+		deny(w, "Access denied by the proxy's access control rules", rule)
+		return
+	}
+
 	if r.Method == http.MethodConnect {
-		p.handleConnect(w, r)
+		if !s.limits.admit(w, r, classMiss) {
+			return
+		}
+		setOutcome(w, outcomeConnect)
+		p.handleConnect(s, w, r)
 		return
 	}
 
@@ -69,76 +288,159 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		targetURL = fmt.Sprintf("%s://%s%s", scheme, r.Host, r.RequestURI)
 	}
+	key, targetURL := s.mirrors.resolve(targetURL)
+
+	matched := s.rules.matchRequest(r.Method, targetURL)
+	if matched != nil && matched.action == config.ActionDeny {
+		logger.Info("request denied", "method", r.Method, "url", targetURL, "rule", matched.desc)
+		deny(w, "Access to this resource is denied", matched.desc)
+		return
+	}
 
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		p.forwardRequest(w, r, targetURL)
+		if !s.limits.admit(w, r, classMiss) {
+			return
+		}
+		setOutcome(w, outcomePassthrough)
+		p.forwardRequest(s, w, r, targetURL, cacheStatus{fwd: fwdMethod}, "")
 		return
 	}
 
-	if p.rules.ShouldPassthrough(targetURL) {
-		log.Printf("[PASSTHROUGH] %s", targetURL)
-		p.forwardRequest(w, r, targetURL)
+	if matched != nil && matched.action == config.ActionBypass {
+		logger.Debug("passthrough", "url", targetURL, "rule", matched.desc)
+		if !s.limits.admit(w, r, classMiss) {
+			return
+		}
+		setOutcome(w, outcomePassthrough)
+		p.forwardRequest(s, w, r, targetURL, cacheStatus{fwd: fwdBypass}, matched.desc)
 		return
 	}
 
-	entry, reader, err := p.storage.Get(targetURL)
+	entry, reader, err := p.storage.Get(r.Context(), key)
 	if err == nil {
-		log.Printf("[CACHE HIT] %s (age: %v)", targetURL, time.Since(entry.CreatedAt).Round(time.Second))
-		p.serveCached(w, entry, reader)
+		logger.Debug("cache hit", "url", key, "age", time.Since(entry.CreatedAt).Round(time.Second).String())
+		if !s.limits.admit(w, r, classHit) {
+			reader.Close()
+			return
+		}
+		setOutcome(w, outcomeHit)
+		p.serveCached(s, w, r, key, entry, reader, cacheStatus{})
+		return
+	}
+
+	if errors.Is(err, cache.ErrNotFound) {
+		logger.Debug("cache miss", "url", key)
+	} else {
+		logger.Debug("cache miss", "url", key, "reason", err)
+	}
+	fwd := fwdReason(err)
+	if !s.limits.admit(w, r, classMiss) {
 		return
 	}
 
-	log.Printf("[CACHE MISS] %s", targetURL)
-	p.fetchAndCache(w, r, targetURL)
+	setOutcome(w, outcomeMiss)
+	p.fetchAndCache(s, w, r, key, fwd)
 }
 
-func (p *Proxy) serveCached(w http.ResponseWriter, entry *cache.CacheEntry, reader io.ReadCloser) {
+// serveCached sends a cached response with the given Cache-Status.
+func (p *Proxy) serveCached(s *settings, w http.ResponseWriter, r *http.Request, key string, entry *cache.CacheEntry, reader io.ReadCloser, status cacheStatus) {
 	defer reader.Close()
 
+	remaining := time.Until(entry.ExpiresAt)
+	status.ttl = remaining
+
 	w.Header().Set("Content-Type", entry.ContentType)
 	for k, v := range entry.Headers {
 		w.Header().Set(k, v)
 	}
+	w.Header().Set("Age", strconv.FormatInt(int64(age(entry)/time.Second), 10))
+	w.Header().Set("Cache-Status", status.String())
 	w.Header().Set("X-Cache", "HIT")
 	w.Header().Set("X-Cache-Created", entry.CreatedAt.Format(time.RFC3339))
+	if digest := entry.DigestHeader(); digest != "" {
+		w.Header().Set("Repr-Digest", digest)
+		w.Header().Set("Digest", entry.LegacyDigestHeader())
+	}
+	matched := s.rules.matchResponse(http.MethodGet, s.mirrors.ruleURL(key), http.StatusOK, entry.ContentType, entry.Size)
+	_, rule := matched.ttlFor(s.config.Cache.DefaultTTL)
+	s.setDebugHeaders(w.Header(), key, rule, remaining)
 
-	io.Copy(w, reader)
+	io.Copy(s.limits.writer(w, w, r, classHit), reader)
 }
 
-func (p *Proxy) fetchAndCache(w http.ResponseWriter, r *http.Request, targetURL string) {
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+// fetchAndCache fetches the object cached under key, the URL or a mirror://
+// key, streams it to the client and stores it.
+func (p *Proxy) fetchAndCache(s *settings, w http.ResponseWriter, r *http.Request, key, fwd string) {
+	inflightDownloads.Inc()
+	defer inflightDownloads.Dec()
+
+	resp, resume, err := p.fetchUpstream(s, w, r, key)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		logger.Warn("upstream fetch failed", "url", key, "err", err)
+		if !p.serveStale(s, w, r, key, err.Error()) {
+			upstreamFailed(w, err, "Failed to fetch resource")
+		}
 		return
 	}
-
-	for k, v := range r.Header {
-		req.Header[k] = v
+	// The body may be replaced by one that resumes it.
+	defer func() { resp.Body.Close() }()
+	if resp.StatusCode >= 500 && p.serveStale(s, w, r, key, resp.Status) {
+		return
 	}
 
-	resp, err := p.client.Do(req)
-	if err != nil {
-		log.Printf("[ERROR] Failed to fetch %s: %v", targetURL, err)
-		http.Error(w, "Failed to fetch resource", http.StatusBadGateway)
+	matched := s.rules.matchResponse(r.Method, s.mirrors.ruleURL(key), resp.StatusCode, resp.Header.Get("Content-Type"), resp.ContentLength)
+	if matched != nil && matched.action == config.ActionDeny {
+		logger.Info("response denied", "url", key, "status", resp.StatusCode, "rule", matched.desc)
+		deny(w, "Access to this resource is denied", matched.desc)
 		return
 	}
-	defer resp.Body.Close()
-
-	shouldCache := resp.StatusCode == http.StatusOK &&
-		(r.Method == http.MethodGet || r.Method == http.MethodHead)
+	matched.rewriteHeaders(resp.Header)
+
+	// HEAD responses have no body to store.
+	shouldCache := resp.StatusCode == http.StatusOK && r.Method == http.MethodGet
+
+	status := cacheStatus{fwd: fwd, fwdStatus: resp.StatusCode}
+	ttl, rule := s.getTTL(matched, resp.Header)
+	if matched != nil && matched.action == config.ActionBypass {
+		logger.Debug("passthrough", "url", key, "rule", matched.desc)
+		setOutcome(w, outcomePassthrough)
+		shouldCache = false
+		status.fwd = fwdBypass
+	}
+	if shouldCache {
+		if err := p.storage.CheckSize(resp.ContentLength); err != nil {
+			logger.Debug("not caching", "url", key, "reason", err)
+			shouldCache = false
+			status.detail = err.Error()
+		}
+	}
+	if shouldCache {
+		status.stored = true
+		status.ttl = ttl
+	}
 
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
+	w.Header().Set("Cache-Status", status.String())
 	w.Header().Set("X-Cache", "MISS")
+	if shouldCache {
+		s.setDebugHeaders(w.Header(), key, rule, ttl)
+	} else {
+		s.setDebugHeaders(w.Header(), key, rule, -1)
+	}
 	w.WriteHeader(resp.StatusCode)
 
+	out := s.limits.writer(w, w, r, classMiss)
 	if !shouldCache {
-		io.Copy(w, resp.Body)
+		io.Copy(out, resp.Body)
 		return
 	}
+	// Only downloads being stored are resumed if they break off.
+	if resume != nil {
+		resp.Body = newResumingBody(resp.Body, resp.ContentLength, resume)
+	}
 
-	ttl := p.getTTL(targetURL, resp.Header)
 	headers := make(map[string]string)
 	for k, v := range resp.Header {
 		if len(v) > 0 {
@@ -154,7 +456,7 @@ func (p *Proxy) fetchAndCache(w http.ResponseWriter, r *http.Request, targetURL
 	errChan := make(chan error, 1)
 	go func() {
 		defer pw.Close()
-		_, err := io.Copy(w, tee)
+		_, err := io.Copy(out, tee)
 		if err != nil {
 			errChan <- err
 		}
@@ -162,30 +464,152 @@ func (p *Proxy) fetchAndCache(w http.ResponseWriter, r *http.Request, targetURL
 	}()
 
 	contentType := resp.Header.Get("Content-Type")
-	err = p.storage.Put(targetURL, contentType, headers, ttl, pr, expectedSize)
-	if err != nil {
-		if strings.Contains(err.Error(), "incomplete download") || strings.Contains(err.Error(), "empty file") {
-			log.Printf("[CACHE ERROR] %s: %v", targetURL, err)
-		} else if strings.Contains(err.Error(), "too small") {
-			log.Printf("[CACHE SKIP] %s: file too small", targetURL)
-		} else if strings.Contains(err.Error(), "too large") {
-			log.Printf("[CACHE SKIP] %s: file too large", targetURL)
-		} else {
-			log.Printf("[CACHE WARNING] %s: %v", targetURL, err)
-		}
-	} else {
-		log.Printf("[CACHE STORED] %s (ttl: %v, size: %d bytes)", targetURL, ttl.Round(time.Second), expectedSize)
+	err = p.storage.Put(r.Context(), key, contentType, headers, ttl, pr, expectedSize)
+	switch {
+	case err == nil:
+		logger.Info("stored", "url", key, "ttl", ttl.Round(time.Second).String(), "size", expectedSize)
+	case errors.Is(err, cache.ErrTooSmall), errors.Is(err, cache.ErrTooLarge):
+		logger.Debug("not caching", "url", key, "reason", err)
+	case errors.Is(err, cache.ErrIncomplete), errors.Is(err, cache.ErrEmpty):
+		logger.Warn("discarded incomplete download", "url", key, "err", err)
+	default:
+		logger.Error("failed to store response", "url", key, "err", err)
 	}
 
 	if err := <-errChan; err != nil {
-		log.Printf("[ERROR] Failed to write response: %v", err)
+		logger.Warn("failed to write response", "url", key, "err", err)
+	}
+}
+
+// Prefetch fetches targetURL in the background and stores it in the cache,
+// e.g. to replace an object the scrubber found corrupt.
+func (p *Proxy) Prefetch(targetURL string) {
+	logger.Info("refetching", "url", targetURL)
+	if _, err := p.fetch(p.current(), targetURL); err != nil {
+		logger.Error("prefetch failed", "url", targetURL, "err", err)
+	}
+}
+
+// Refresh drops any cached copy of targetURL and fetches it again, returning
+// the new cache entry. A URL under a mirror pool refreshes the pool's copy.
+func (p *Proxy) Refresh(targetURL string) (*cache.CacheEntry, error) {
+	s := p.current()
+	targetURL, _ = s.mirrors.resolve(targetURL)
+	if err := p.storage.Delete(targetURL); err != nil {
+		return nil, fmt.Errorf("failed to drop cached copy: %w", err)
+	}
+
+	status, err := p.fetch(s, targetURL)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("origin returned status %d", status)
+	}
+
+	entry, err := p.storage.Lookup(targetURL)
+	if err != nil {
+		return nil, fmt.Errorf("response was not cached")
 	}
+	return entry, nil
+}
+
+// Snapshot returns the live counters shown on the dashboard.
+func (p *Proxy) Snapshot() Snapshot {
+	snap := p.stats.snapshot()
+	snap.Inflight = int64(inflightDownloads.Value())
+	snap.Egress = p.current().egress.Health()
+	return snap
+}
+
+// Evaluate reports what the rules decide for targetURL.
+func (p *Proxy) Evaluate(targetURL string) Decision {
+	s := p.current()
+	return evaluate(s.rules, s.mirrors, s.config.Cache.DefaultTTL, targetURL)
+}
+
+// Evaluator makes the decisions a proxy running with a configuration would
+// make, without starting one.
+type Evaluator struct {
+	rules      *Rules
+	mirrors    mirrorPools
+	defaultTTL time.Duration
 }
 
-func (p *Proxy) forwardRequest(w http.ResponseWriter, r *http.Request, targetURL string) {
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+func NewEvaluator(cfg *config.Config) (*Evaluator, error) {
+	profiles, err := cfg.Profiles.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve profiles: %w", err)
+	}
+	rules, err := NewRules(cfg.Rules, profiles)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return nil, fmt.Errorf("failed to create rules: %w", err)
+	}
+	return &Evaluator{rules: rules, mirrors: newMirrorPools(cfg.Mirrors), defaultTTL: cfg.Cache.DefaultTTL}, nil
+}
+
+// Evaluate reports what the proxy would do with a request for targetURL.
+func (e *Evaluator) Evaluate(targetURL string) Decision {
+	return evaluate(e.rules, e.mirrors, e.defaultTTL, targetURL)
+}
+
+// evaluate matches the rules against the URL a request for targetURL is
+// handled as, which for a mirror pool is its first mirror's.
+func evaluate(rules *Rules, mirrors mirrorPools, defaultTTL time.Duration, targetURL string) Decision {
+	key, ruleURL := mirrors.resolve(targetURL)
+	d := rules.Evaluate(ruleURL, defaultTTL)
+	d.URL = targetURL
+	d.Key = cache.Key(key)
+	if key != targetURL {
+		d.Mirror = key
+	}
+	return d
+}
+
+// Profiles returns every repository profile, enabled or not.
+func (p *Proxy) Profiles() []config.Profile {
+	return p.current().profiles
+}
+
+// Config returns the configuration the proxy is running with.
+func (p *Proxy) Config() *config.Config {
+	return p.current().config
+}
+
+// fetch runs a GET for targetURL through the caching path with no client
+// attached and returns the upstream status.
+func (p *Proxy) fetch(s *settings, targetURL string) (int, error) {
+	ctx, span := tracing.Start(context.Background(), "proxy fetch", tracing.KindInternal)
+	defer span.End()
+	span.Set("url.full", targetURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	dw := &discardResponseWriter{header: make(http.Header)}
+	p.fetchAndCache(s, dw, req, targetURL, fwdMiss)
+	return dw.status, nil
+}
+
+// discardResponseWriter is the http.ResponseWriter used for fetches that have
+// no client attached.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(status int)      { d.status = status }
+
+// forwardRequest relays a request the cache does not handle. status and rule
+// say why, for the Cache-Status and debug headers.
+func (p *Proxy) forwardRequest(s *settings, w http.ResponseWriter, r *http.Request, targetURL string, status cacheStatus, rule string) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
+	if err != nil {
+		fail(w, "Failed to create request", http.StatusInternalServerError)
 		return
 	}
 
@@ -193,10 +617,10 @@ func (p *Proxy) forwardRequest(w http.ResponseWriter, r *http.Request, targetURL
 		req.Header[k] = v
 	}
 
-	resp, err := p.client.Do(req)
+	resp, err := p.doUpstream(s, w, req)
 	if err != nil {
-		log.Printf("[ERROR] Failed to forward %s: %v", targetURL, err)
-		http.Error(w, "Failed to forward request", http.StatusBadGateway)
+		logger.Warn("upstream forward failed", "url", targetURL, "err", err)
+		upstreamFailed(w, err, "Failed to forward request")
 		return
 	}
 	defer resp.Body.Close()
@@ -204,62 +628,168 @@ func (p *Proxy) forwardRequest(w http.ResponseWriter, r *http.Request, targetURL
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
+	status.fwdStatus = resp.StatusCode
+	w.Header().Set("Cache-Status", status.String())
+	s.setDebugHeaders(w.Header(), targetURL, rule, -1)
 	w.WriteHeader(resp.StatusCode)
 
-	io.Copy(w, resp.Body)
+	io.Copy(s.limits.writer(w, w, r, classMiss), resp.Body)
 }
 
-func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+func (p *Proxy) handleConnect(s *settings, w http.ResponseWriter, r *http.Request) {
 	host := r.Host
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
 	}
 
-	if !p.rules.ShouldAllowHTTPS(host) {
-		log.Printf("[CONNECT BLOCKED] %s (not in https_passthrough)", r.Host)
-		http.Error(w, "CONNECT not allowed for this destination", http.StatusForbidden)
+	allowed, rule := s.rules.allowConnect(host)
+	if !allowed {
+		if rule == "" {
+			rule = "no tunnel rule"
+		}
+		logger.Info("CONNECT blocked", "host", r.Host, "rule", rule)
+		deny(w, "CONNECT not allowed for this destination", rule)
 		return
 	}
 
-	log.Printf("[CONNECT ALLOWED] %s", r.Host)
+	logger.Debug("CONNECT allowed", "host", r.Host, "rule", rule)
+	addUpstream(w, r.Host, 0)
 
-	destConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	destConn, err := s.egress.DialContext(ctx, "tcp", r.Host)
+	cancel()
 	if err != nil {
-		http.Error(w, "Failed to connect to destination", http.StatusBadGateway)
+		logger.Warn("CONNECT failed", "host", r.Host, "err", err)
+		upstreamFailed(w, err, "Failed to connect to destination")
 		return
 	}
 	defer destConn.Close()
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		fail(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
 
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
-		http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
+		fail(w, "Failed to hijack connection", http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
 
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	setStatus(w, http.StatusOK)
 
 	go io.Copy(destConn, clientConn)
-	io.Copy(clientConn, destConn)
+	n, _ := io.Copy(s.limits.writer(clientConn, w, r, classMiss), destConn)
+	addBytes(w, n)
+}
+
+// fetchUpstream requests the object cached under key from its origin or,
+// for a mirror:// key, from the pool's mirrors. resume, if not nil, fetches
+// the rest of a GET response body that ends early.
+func (p *Proxy) fetchUpstream(s *settings, w http.ResponseWriter, r *http.Request, key string) (*http.Response, resumeFunc, error) {
+	pool, path, ok := s.mirrors.lookup(key)
+	if !ok {
+		req, err := newUpstreamRequest(r, r.Method, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := p.doUpstream(s, w, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		var resume resumeFunc
+		if r.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+			if rs := p.newResumer(s, w, r, resp); rs != nil {
+				resume = rs.fromOrigin(resp.Request.URL.String())
+			}
+		}
+		return resp, resume, nil
+	}
+	if pool == nil {
+		return nil, nil, fmt.Errorf("no mirror pool for %s", key)
+	}
+	return p.fetchMirror(s, w, r, pool, path)
+}
+
+// serveStale serves the expired copy of key in place of a failed
+// fetch, if the cache still has one.
+func (p *Proxy) serveStale(s *settings, w http.ResponseWriter, r *http.Request, key, reason string) bool {
+	entry, reader, err := p.storage.GetStale(r.Context(), key)
+	if err != nil {
+		return false
+	}
+	logger.Info("serving stale", "url", key, "expired", time.Since(entry.ExpiresAt).Round(time.Second).String(), "reason", reason)
+	setOutcome(w, outcomeStale)
+	p.serveCached(s, w, r, key, entry, reader, cacheStatus{detail: "stale: " + reason})
+	return true
+}
+
+// doUpstream sends req to the origin and records how long the response
+// headers took to arrive.
+func (p *Proxy) doUpstream(s *settings, w http.ResponseWriter, req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Start(req.Context(), "upstream "+req.Method, tracing.KindClient)
+	defer span.End()
+	span.Set("http.request.method", req.Method)
+	span.Set("url.full", req.URL.String())
+	span.Set("server.address", req.URL.Hostname())
+
+	req = req.WithContext(httptrace.WithClientTrace(ctx, clientTrace(ctx)))
+	tracing.Inject(ctx, req.Header)
+
+	release, err := s.upstreams.acquire(ctx, req.URL.Host)
+	if err != nil {
+		span.Fail(err)
+		addUpstream(w, req.URL.Host, 0)
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	elapsed := time.Since(start)
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// The client went away; that says nothing about the origin.
+		span.Fail(err)
+		release(0, nil)
+	case err != nil:
+		span.Fail(err)
+		release(0, err)
+	default:
+		span.Set("http.response.status_code", resp.StatusCode)
+		withRelease(resp, release)
+	}
+
+	upstreamDurationSeconds.WithLabelValues(s.hostGroups.group(req.URL.Hostname())).Observe(elapsed.Seconds())
+	addUpstream(w, req.URL.Host, elapsed)
+	return resp, err
+}
+
+// getTTL returns the TTL for a response and a description of the rule or
+// header that set it. Cache-Control can only lower the rule's TTL, and the
+// rule's min_ttl and max_ttl apply last.
+func (s *settings) getTTL(matched *rule, headers http.Header) (time.Duration, string) {
+	ttl, desc := s.headerTTL(matched, headers)
+	if clamped := matched.clamp(ttl); clamped != ttl {
+		return clamped, matched.desc
+	}
+	return ttl, desc
 }
 
-func (p *Proxy) getTTL(url string, headers http.Header) time.Duration {
-	ttl := p.rules.GetTTL(url, p.config.Cache.DefaultTTL)
+func (s *settings) headerTTL(matched *rule, headers http.Header) (time.Duration, string) {
+	ttl, desc := matched.ttlFor(s.config.Cache.DefaultTTL)
 
-	if !p.config.Cache.RespectHeaders {
-		return ttl
+	if !s.config.Cache.RespectHeaders {
+		return ttl, desc
 	}
 
 	cacheControl := headers.Get("Cache-Control")
 	if cacheControl != "" {
 		if strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "no-store") {
-			return 0
+			return 0, "cache-control: " + cacheControl
 		}
 
 		if strings.Contains(cacheControl, "max-age=") {
@@ -268,11 +798,11 @@ func (p *Proxy) getTTL(url string, headers http.Header) time.Duration {
 			if maxAge > 0 {
 				headerTTL := time.Duration(maxAge) * time.Second
 				if headerTTL < ttl {
-					return headerTTL
+					return headerTTL, "cache-control: " + cacheControl
 				}
 			}
 		}
 	}
 
-	return ttl
+	return ttl, desc
 }
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cascade/internal/metrics"
+)
+
+var upstreamResumesTotal = metrics.Default.NewCounterVec(
+	"cascade_upstream_resumes_total",
+	"Attempts to resume an interrupted download from its origin or a pool mirror, by result: ok or error.",
+	"result", "host_group")
+
+// resumeBackoff is how much longer each attempt to resume a download waits
+// than the one before.
+const resumeBackoff = time.Second
+
+// resumeFunc fetches the rest of a response body from offset on. It returns
+// an error if the rest cannot be fetched or might not belong to the same
+// object.
+type resumeFunc func(offset int64) (io.ReadCloser, error)
+
+// resumingBody reads a response body of known size and, if it ends early,
+// continues with the rest fetched by resume, so the reader sees one complete
+// body.
+type resumingBody struct {
+	body   io.ReadCloser
+	offset int64
+	size   int64
+	resume resumeFunc
+}
+
+func newResumingBody(body io.ReadCloser, size int64, resume resumeFunc) io.ReadCloser {
+	if size <= 0 {
+		return body
+	}
+	return &resumingBody{body: body, size: size, resume: resume}
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || (err == io.EOF && b.offset >= b.size) {
+			return n, err
+		}
+		if n > 0 {
+			// Hand over what arrived; the next Read hits the error again.
+			return n, nil
+		}
+
+		b.body.Close()
+		rest, rerr := b.resume(b.offset)
+		if rerr != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, fmt.Errorf("%w; resuming at byte %d failed: %v", err, b.offset, rerr)
+		}
+		b.body = rest
+	}
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
+
+// resumer fetches the rest of an interrupted download with Range requests
+// carrying If-Range, so the rest is only accepted if the object has not
+// changed. It makes at most retries attempts over the whole download.
+type resumer struct {
+	p         *Proxy
+	s         *settings
+	w         http.ResponseWriter
+	r         *http.Request
+	validator string
+	size      int64
+	retries   int
+	attempts  int
+}
+
+// newResumer returns a resumer for resp, or nil if resuming is disabled for
+// the host resp came from or resp has neither a strong ETag nor a
+// Last-Modified date to validate the rest against.
+func (p *Proxy) newResumer(s *settings, w http.ResponseWriter, r *http.Request, resp *http.Response) *resumer {
+	retries := s.config.Upstreams.For(resp.Request.URL.Hostname()).ResumeRetries
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if retries <= 0 || validator == "" || resp.ContentLength <= 0 {
+		return nil
+	}
+	return &resumer{p: p, s: s, w: w, r: r, validator: validator, size: resp.ContentLength, retries: retries}
+}
+
+// exhausted reports whether every attempt has been used.
+func (rs *resumer) exhausted() bool {
+	return rs.attempts >= rs.retries
+}
+
+// try requests the rest of the object from targetURL from offset on. Each
+// attempt after the first waits resumeBackoff longer than the one before.
+func (rs *resumer) try(targetURL string, offset int64) (io.ReadCloser, error) {
+	rs.attempts++
+	if rs.attempts > 1 {
+		t := time.NewTimer(time.Duration(rs.attempts-1) * resumeBackoff)
+		select {
+		case <-t.C:
+		case <-rs.r.Context().Done():
+			t.Stop()
+			return nil, rs.r.Context().Err()
+		}
+	}
+
+	req, err := newResumeRequest(rs.r, targetURL, offset)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("If-Range", rs.validator)
+
+	group := rs.s.hostGroups.group(req.URL.Hostname())
+	resp, err := rs.p.doUpstream(rs.s, rs.w, req)
+	if err == nil {
+		// A changed object comes back whole with a 200, which fails here.
+		if err = checkPartial(resp, offset, rs.size); err != nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		upstreamResumesTotal.WithLabelValues("error", group).Inc()
+		return nil, err
+	}
+	upstreamResumesTotal.WithLabelValues("ok", group).Inc()
+	return resp.Body, nil
+}
+
+// giveUp returns the error for a download that could not be resumed.
+func (rs *resumer) giveUp(lastErr error) error {
+	if lastErr == nil {
+		return fmt.Errorf("gave up after %d attempts", rs.attempts)
+	}
+	return lastErr
+}
+
+// fromOrigin returns a resumeFunc that fetches the rest from targetURL.
+func (rs *resumer) fromOrigin(targetURL string) resumeFunc {
+	return func(offset int64) (io.ReadCloser, error) {
+		logger.Warn("download interrupted", "url", targetURL, "offset", offset, "size", rs.size)
+		var lastErr error
+		for !rs.exhausted() {
+			body, err := rs.try(targetURL, offset)
+			if err == nil {
+				logger.Info("resumed download", "url", targetURL, "offset", offset, "attempt", rs.attempts)
+				return body, nil
+			}
+			logger.Warn("resuming download failed", "url", targetURL, "attempt", rs.attempts, "err", err)
+			lastErr = err
+			if rs.r.Context().Err() != nil {
+				break
+			}
+		}
+		return nil, rs.giveUp(lastErr)
+	}
+}
+
+// newResumeRequest builds a request for targetURL from offset on, for the
+// client request r. Conditions the client sent are dropped; they were
+// settled by the response being resumed.
+func newResumeRequest(r *http.Request, targetURL string, offset int64) (*http.Request, error) {
+	req, err := newUpstreamRequest(r, http.MethodGet, targetURL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	for _, h := range []string{"If-Range", "If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(h)
+	}
+	return req, nil
+}
+
+// checkPartial verifies that resp is the rest of an object of size bytes
+// from offset on.
+func checkPartial(resp *http.Response, offset, size int64) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range request answered with status %d", resp.StatusCode)
+	}
+	first, last, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if first != offset || last != size-1 || total != size {
+		return fmt.Errorf("Content-Range %q does not continue %d of %d bytes", resp.Header.Get("Content-Range"), offset, size)
+	}
+	return nil
+}
+
+func parseContentRange(s string) (first, last, total int64, err error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, 0, errors.New("missing or invalid Content-Range")
+	}
+	rng, size, _ := strings.Cut(spec, "/")
+	from, to, _ := strings.Cut(rng, "-")
+	if first, err = strconv.ParseInt(from, 10, 64); err == nil {
+		if last, err = strconv.ParseInt(to, 10, 64); err == nil {
+			total, err = strconv.ParseInt(size, 10, 64)
+		}
+	}
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return first, last, total, nil
+}
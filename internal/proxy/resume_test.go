@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckPartial(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		contentRange string
+		offset, size int64
+		ok           bool
+	}{
+		{"rest of the object", 206, "bytes 400-999/1000", 400, 1000, true},
+		{"last byte", 206, "bytes 999-999/1000", 999, 1000, true},
+		{"whole object instead", 200, "", 400, 1000, false},
+		{"200 with a Content-Range", 200, "bytes 400-999/1000", 400, 1000, false},
+		{"missing Content-Range", 206, "", 400, 1000, false},
+		{"wrong unit", 206, "items 400-999/1000", 400, 1000, false},
+		{"unknown size", 206, "bytes 400-999/*", 400, 1000, false},
+		{"unsatisfied", 206, "bytes */1000", 400, 1000, false},
+		{"not a number", 206, "bytes 4x0-999/1000", 400, 1000, false},
+		{"wrong offset", 206, "bytes 0-999/1000", 400, 1000, false},
+		{"short range", 206, "bytes 400-899/1000", 400, 1000, false},
+		{"object changed size", 206, "bytes 400-1199/1200", 400, 1000, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.contentRange != "" {
+			resp.Header.Set("Content-Range", tt.contentRange)
+		}
+		err := checkPartial(resp, tt.offset, tt.size)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkPartial(%d, %q) = %v, want ok %v", tt.name, tt.status, tt.contentRange, err, tt.ok)
+		}
+	}
+}
+
+// chunks is a body that returns each chunk from one Read and then err.
+type chunks struct {
+	parts  []string
+	err    error
+	closed bool
+}
+
+func (c *chunks) Read(p []byte) (int, error) {
+	if len(c.parts) == 0 {
+		return 0, c.err
+	}
+	n := copy(p, c.parts[0])
+	c.parts[0] = c.parts[0][n:]
+	if c.parts[0] == "" {
+		c.parts = c.parts[1:]
+	}
+	return n, nil
+}
+
+func (c *chunks) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestResumingBody(t *testing.T) {
+	const object = "0123456789abcdefghij"
+	broken := errors.New("connection reset by peer")
+
+	tests := []struct {
+		name    string
+		first   *chunks
+		rests   []*chunks // handed out by resume in turn
+		offsets []int64   // resume is called with
+		want    string
+		err     bool
+	}{
+		{
+			name:  "complete",
+			first: &chunks{parts: []string{"0123456789", "abcdefghij"}, err: io.EOF},
+			want:  object,
+		},
+		{
+			name:    "resumed once after a reset",
+			first:   &chunks{parts: []string{"01234", "567"}, err: broken},
+			rests:   []*chunks{{parts: []string{"89abcdefghij"}, err: io.EOF}},
+			offsets: []int64{8},
+			want:    object,
+		},
+		{
+			name:  "resumed twice after early EOFs",
+			first: &chunks{parts: []string{"0123"}, err: io.EOF},
+			rests: []*chunks{
+				{parts: []string{"456789ab"}, err: io.EOF},
+				{parts: []string{"cdefghij"}, err: io.EOF},
+			},
+			offsets: []int64{4, 12},
+			want:    object,
+		},
+		{
+			name:    "resume fails",
+			first:   &chunks{parts: []string{"0123456789"}, err: io.EOF},
+			offsets: []int64{10},
+			want:    "0123456789",
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		var offsets []int64
+		var bodies []*chunks
+		rests := tt.rests
+		body := newResumingBody(tt.first, int64(len(object)), func(offset int64) (io.ReadCloser, error) {
+			offsets = append(offsets, offset)
+			if len(rests) == 0 {
+				return nil, errors.New("gave up after 3 attempts")
+			}
+			rest := rests[0]
+			rests = rests[1:]
+			bodies = append(bodies, rest)
+			return rest, nil
+		})
+
+		got, err := io.ReadAll(body)
+		if string(got) != tt.want {
+			t.Errorf("%s: read %q, want %q", tt.name, got, tt.want)
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v, want an error %v", tt.name, err, tt.err)
+		}
+		if tt.err && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: err = %v, want it to wrap io.ErrUnexpectedEOF", tt.name, err)
+		}
+		if len(offsets) != len(tt.offsets) {
+			t.Errorf("%s: resumed at %v, want %v", tt.name, offsets, tt.offsets)
+		} else {
+			for i := range offsets {
+				if offsets[i] != tt.offsets[i] {
+					t.Errorf("%s: resumed at %v, want %v", tt.name, offsets, tt.offsets)
+					break
+				}
+			}
+		}
+		if len(tt.offsets) > 0 && !tt.first.closed {
+			t.Errorf("%s: broken body not closed before resuming", tt.name)
+		}
+		body.Close()
+		for i, b := range bodies {
+			if i < len(bodies)-1 && !b.closed {
+				t.Errorf("%s: resumed body %d not closed", tt.name, i)
+			}
+		}
+		if len(bodies) > 0 && !bodies[len(bodies)-1].closed {
+			t.Errorf("%s: Close did not close the current body", tt.name)
+		}
+	}
+}
+
+func TestResumingBodyUnknownSize(t *testing.T) {
+	first := &chunks{parts: []string{"partial"}, err: io.ErrUnexpectedEOF}
+	body := newResumingBody(first, -1, func(int64) (io.ReadCloser, error) {
+		t.Fatal("resumed a body of unknown size")
+		return nil, nil
+	})
+	if body != io.ReadCloser(first) {
+		t.Fatal("newResumingBody wrapped a body of unknown size")
+	}
+}
+
+func TestNewResumeRequest(t *testing.T) {
+	client, err := http.NewRequest(http.MethodGet, "http://deb.debian.org/debian/pool/a.deb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Header.Set("If-None-Match", `"abc"`)
+	client.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	client.Header.Set("If-Range", `"old"`)
+	client.Header.Set("User-Agent", "Debian APT-HTTP/1.3")
+
+	req, err := newResumeRequest(client, "http://mirror.example.com/debian/pool/a.deb", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Range"); got != "bytes=1234-" {
+		t.Errorf("Range = %q, want bytes=1234-", got)
+	}
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Range"} {
+		if req.Header.Get(h) != "" {
+			t.Errorf("%s = %q, want the client's condition dropped", h, req.Header.Get(h))
+		}
+	}
+	if req.Header.Get("User-Agent") != "Debian APT-HTTP/1.3" {
+		t.Errorf("User-Agent = %q, want the client's", req.Header.Get("User-Agent"))
+	}
+	if !strings.HasPrefix(req.URL.String(), "http://mirror.example.com/") {
+		t.Errorf("URL = %s, want the mirror's", req.URL)
+	}
+}
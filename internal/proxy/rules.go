@@ -1,89 +1,419 @@
 package proxy
 
 import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
+
+	"cascade/internal/cache"
+	"cascade/internal/config"
+	"cascade/internal/match"
 )
 
+// Rules decides, per request and again once the response headers are known,
+// whether to cache, bypass the cache, deny or tunnel, and with which TTL. The
+// first matching rule wins; rules are tried by descending priority and then in
+// configuration order.
 type Rules struct {
-	passthrough      []string
-	httpsPassthrough []string
-	specialTTL       map[string]time.Duration
+	rules []*rule
 }
 
-func NewRules(passthrough []string, httpsPassthrough []string, specialTTL map[string]string) (*Rules, error) {
-	ttlMap := make(map[string]time.Duration)
-	for pattern, ttlStr := range specialTTL {
-		ttl, err := time.ParseDuration(ttlStr)
-		if err != nil {
-			return nil, err
+// rule is a compiled rules entry. All non-empty criteria must hold.
+type rule struct {
+	desc     string
+	priority int
+	action   string
+	ttl      time.Duration
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	headers  config.HeaderRewrite
+
+	hosts        []string
+	paths        []string
+	regex        *regexp.Regexp
+	methods      []string
+	contentTypes []string
+	status       []int
+	minSize      int64
+	maxSize      int64
+
+	// urlGlob and hostGlob carry the legacy patterns, which keep their
+	// original match.Glob semantics.
+	urlGlob  string
+	hostGlob string
+}
+
+// NewRules compiles the configured rules followed by the enabled repository
+// profiles, so a configured rule always wins over a profile.
+func NewRules(cfg config.RulesConfig, profiles []config.Profile) (*Rules, error) {
+	var rules []*rule
+
+	if cfg.IsLegacy() {
+		rules = legacyRules(cfg)
+	} else {
+		for i, rc := range cfg.List {
+			r, err := compileRule(rc)
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			r.desc = fmt.Sprintf("rules[%d]", i)
+			if rc.Name != "" {
+				r.desc += " (" + rc.Name + ")"
+			}
+			rules = append(rules, r)
 		}
-		ttlMap[pattern] = ttl
 	}
+	rules = append(rules, profileRules(profiles)...)
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].priority > rules[j].priority
+	})
 
-	return &Rules{
-		passthrough:      passthrough,
-		httpsPassthrough: httpsPassthrough,
-		specialTTL:       ttlMap,
-	}, nil
+	return &Rules{rules: rules}, nil
 }
 
-func (r *Rules) ShouldPassthrough(url string) bool {
-	for _, pattern := range r.passthrough {
-		if matchPattern(url, pattern) {
-			return true
+func compileRule(rc config.RuleConfig) (*rule, error) {
+	r := &rule{
+		priority:     rc.Priority,
+		action:       rc.Action,
+		ttl:          rc.TTL,
+		minTTL:       rc.MinTTL,
+		maxTTL:       rc.MaxTTL,
+		headers:      rc.Headers,
+		paths:        rc.Match.Path,
+		methods:      rc.Match.Method,
+		status:       rc.Match.Status,
+		minSize:      int64(rc.Match.MinSize),
+		maxSize:      int64(rc.Match.MaxSize),
+		contentTypes: lowerAll(rc.Match.ContentType),
+		hosts:        lowerAll(rc.Match.Host),
+	}
+	if r.action == "" {
+		r.action = config.ActionCache
+	}
+	if rc.Match.Regex != "" {
+		re, err := regexp.Compile(rc.Match.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
 		}
+		r.regex = re
 	}
-	return false
+	return r, nil
 }
 
-func (r *Rules) ShouldAllowHTTPS(host string) bool {
-	for _, pattern := range r.httpsPassthrough {
-		if matchPattern(host, pattern) {
-			return true
+// legacyRules translates the passthrough, https_passthrough and special_ttl
+// settings, in that order. special_ttl is a map, so its patterns are ordered longest first
+// to make overlapping patterns resolve the same way on every run.
+func legacyRules(cfg config.RulesConfig) []*rule {
+	var rules []*rule
+
+	for _, pattern := range cfg.Passthrough {
+		rules = append(rules, &rule{desc: "passthrough: " + pattern, action: config.ActionBypass, urlGlob: pattern})
+	}
+	for _, pattern := range cfg.HTTPSPassthrough {
+		rules = append(rules, &rule{desc: "https_passthrough: " + pattern, action: config.ActionTunnel, hostGlob: pattern})
+	}
+
+	patterns := make([]string, 0, len(cfg.SpecialTTL))
+	for pattern := range cfg.SpecialTTL {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
 		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		// Load has already validated the durations.
+		ttl, _ := time.ParseDuration(cfg.SpecialTTL[pattern])
+		rules = append(rules, &rule{desc: "special_ttl: " + pattern, action: config.ActionCache, ttl: ttl, urlGlob: pattern})
 	}
-	return false
+
+	return rules
 }
 
-func (r *Rules) GetTTL(url string, defaultTTL time.Duration) time.Duration {
-	if strings.Contains(url, "InRelease") || strings.Contains(url, "Release.gpg") {
-		return 5 * time.Minute
+// profileRules turns each enabled profile into a cache rule for its
+// artifacts, then one for its metadata.
+func profileRules(profiles []config.Profile) []*rule {
+	var rules []*rule
+	for _, profile := range profiles {
+		if !profile.Enabled {
+			continue
+		}
+		for _, group := range []struct {
+			kind string
+			config.ProfileGroup
+		}{{"artifacts", profile.Artifacts}, {"metadata", profile.Metadata}} {
+			if len(group.Paths) == 0 {
+				continue
+			}
+			rules = append(rules, &rule{
+				desc:   fmt.Sprintf("profile %s: %s", profile.Name, group.kind),
+				action: config.ActionCache,
+				ttl:    group.TTL,
+				hosts:  lowerAll(profile.Hosts),
+				paths:  group.Paths,
+			})
+		}
 	}
+	return rules
+}
 
-	if strings.Contains(url, "/Release") && !strings.Contains(url, "InRelease") {
-		return 30 * time.Minute
+// subject is what a rule is matched against. Response fields are only set
+// once the upstream response has arrived; size is -1 when unknown.
+type subject struct {
+	method      string
+	url         string
+	host        string
+	path        string
+	response    bool
+	status      int
+	contentType string
+	size        int64
+}
+
+func newSubject(method, rawURL string) subject {
+	s := subject{method: method, url: rawURL, host: rawURL, size: -1}
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		s.host = u.Hostname()
+		s.path = u.Path
 	}
+	return s
+}
 
-	if strings.Contains(url, "/Packages") || strings.Contains(url, "/Sources") {
-		return 1 * time.Hour
+func (r *rule) needsResponse() bool {
+	return len(r.contentTypes) > 0 || len(r.status) > 0 || r.minSize > 0 || r.maxSize > 0
+}
+
+func (r *rule) matches(s subject) bool {
+	if r.urlGlob != "" && !match.Glob(s.url, r.urlGlob) {
+		return false
+	}
+	if r.hostGlob != "" && !match.Glob(s.host, r.hostGlob) {
+		return false
+	}
+	if len(r.hosts) > 0 && !anyWildcard(strings.ToLower(s.host), r.hosts) {
+		return false
+	}
+	if len(r.paths) > 0 && !anyWildcard(s.path, r.paths) {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(s.url) {
+		return false
+	}
+	if len(r.methods) > 0 && !anyEqualFold(s.method, r.methods) {
+		return false
 	}
 
-	for pattern, ttl := range r.specialTTL {
-		if matchPattern(url, pattern) {
-			return ttl
+	if !r.needsResponse() {
+		return true
+	}
+	if !s.response {
+		return false
+	}
+	if len(r.status) > 0 && !containsInt(r.status, s.status) {
+		return false
+	}
+	if len(r.contentTypes) > 0 {
+		mediaType, _, err := mime.ParseMediaType(s.contentType)
+		if err != nil || !anyWildcard(mediaType, r.contentTypes) {
+			return false
 		}
 	}
+	if r.minSize > 0 && (s.size < 0 || s.size < r.minSize) {
+		return false
+	}
+	if r.maxSize > 0 && (s.size < 0 || s.size > r.maxSize) {
+		return false
+	}
+	return true
+}
 
-	return defaultTTL
+// find returns the first rule that matches s, skipping tunnel rules, which
+// only apply to CONNECT. It returns nil if none does.
+func (r *Rules) find(s subject) *rule {
+	for _, rule := range r.rules {
+		if rule.action == config.ActionTunnel {
+			continue
+		}
+		if rule.matches(s) {
+			return rule
+		}
+	}
+	return nil
 }
 
-func matchPattern(s, pattern string) bool {
-	if pattern == "*" {
-		return true
+// matchRequest returns the rule for a request before it is sent upstream.
+// Rules that need the response are skipped.
+func (r *Rules) matchRequest(method, rawURL string) *rule {
+	return r.find(newSubject(method, rawURL))
+}
+
+// matchResponse returns the rule for a response. size is the Content-Length,
+// or -1 if unknown.
+func (r *Rules) matchResponse(method, rawURL string, status int, contentType string, size int64) *rule {
+	s := newSubject(method, rawURL)
+	s.response = true
+	s.status = status
+	s.contentType = contentType
+	s.size = size
+	return r.find(s)
+}
+
+// allowConnect reports whether a CONNECT tunnel to host is allowed and which
+// rule decided. Only tunnel and deny rules that match on the host alone are
+// considered; anything else is refused.
+func (r *Rules) allowConnect(host string) (bool, string) {
+	s := subject{method: http.MethodConnect, host: host, size: -1}
+	for _, rule := range r.rules {
+		if rule.action != config.ActionTunnel && rule.action != config.ActionDeny {
+			continue
+		}
+		if rule.urlGlob != "" || len(rule.paths) > 0 || rule.regex != nil || rule.needsResponse() {
+			continue
+		}
+		if rule.matches(s) {
+			return rule.action == config.ActionTunnel, rule.desc
+		}
+	}
+	return false, ""
+}
+
+// ttlFor returns the TTL the rule sets and its description, or defaultTTL when
+// there is no rule or the rule leaves the TTL unset.
+func (r *rule) ttlFor(defaultTTL time.Duration) (time.Duration, string) {
+	if r == nil {
+		return defaultTTL, "default_ttl"
+	}
+	if r.ttl > 0 {
+		return r.ttl, r.desc
 	}
+	return defaultTTL, r.desc
+}
 
-	if strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*") {
-		return strings.Contains(s, pattern[1:len(pattern)-1])
+// clamp applies the rule's min_ttl and max_ttl.
+func (r *rule) clamp(ttl time.Duration) time.Duration {
+	if r == nil {
+		return ttl
+	}
+	if r.minTTL > 0 && ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
 	}
+	return ttl
+}
 
-	if strings.HasPrefix(pattern, "*") {
-		return strings.HasSuffix(s, pattern[1:])
+// rewriteHeaders applies the rule's header changes to h.
+func (r *rule) rewriteHeaders(h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.headers.Remove {
+		h.Del(name)
+	}
+	for name, value := range r.headers.Set {
+		h.Set(name, value)
 	}
+}
+
+// Decision describes how the rules treat a URL and which rule decided it.
+type Decision struct {
+	URL string `json:"url"`
+	Key string `json:"key"`
+	// Mirror is the mirror:// URL the object is cached under, if the URL
+	// belongs to a mirror pool.
+	Mirror          string        `json:"mirror,omitempty"`
+	Action          string        `json:"action"`
+	Rule            string        `json:"rule,omitempty"`
+	Passthrough     bool          `json:"passthrough"`
+	PassthroughRule string        `json:"passthrough_rule,omitempty"`
+	Denied          bool          `json:"denied"`
+	ConnectAllowed  bool          `json:"connect_allowed"`
+	ConnectRule     string        `json:"connect_rule,omitempty"`
+	TTL             time.Duration `json:"-"`
+	TTLString       string        `json:"ttl"`
+	TTLRule         string        `json:"ttl_rule"`
+	// ResponseRules lists rules that could still apply once the response
+	// status, content type or size is known.
+	ResponseRules []string `json:"response_rules,omitempty"`
+}
 
-	if strings.HasSuffix(pattern, "*") {
-		return strings.HasPrefix(s, pattern[:len(pattern)-1])
+// Evaluate reports what the rules decide for a GET of url without fetching
+// anything.
+func (r *Rules) Evaluate(rawURL string, defaultTTL time.Duration) Decision {
+	d := Decision{URL: rawURL, Key: cache.Key(rawURL), Action: config.ActionCache}
+
+	s := newSubject(http.MethodGet, rawURL)
+	matched := r.find(s)
+	if matched != nil {
+		d.Action = matched.action
+		d.Rule = matched.desc
+	}
+	switch d.Action {
+	case config.ActionBypass:
+		d.Passthrough = true
+		d.PassthroughRule = matched.desc
+	case config.ActionDeny:
+		d.Denied = true
 	}
 
-	return strings.Contains(s, pattern)
+	d.ConnectAllowed, d.ConnectRule = r.allowConnect(s.host)
+
+	d.TTL, d.TTLRule = matched.ttlFor(defaultTTL)
+	d.TTL = matched.clamp(d.TTL)
+	d.TTLString = d.TTL.String()
+
+	for _, rule := range r.rules {
+		if rule == matched {
+			break
+		}
+		if rule.action != config.ActionTunnel && rule.needsResponse() {
+			d.ResponseRules = append(d.ResponseRules, rule.desc)
+		}
+	}
+
+	return d
+}
+
+func lowerAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
+
+func anyWildcard(s string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if match.Wildcard(s, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyEqualFold(s string, list []string) bool {
+	for _, v := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxTrackedHosts   = 500
+	maxTrackedObjects = 2000
+	topN              = 10
+	maxRecentErrors   = 50
+)
+
+// Snapshot is the live view of proxy activity shown on the dashboard. It
+// covers the time since the process started.
+type Snapshot struct {
+	StartedAt     time.Time        `json:"started_at"`
+	Requests      map[string]int64 `json:"requests"`
+	CacheBytes    int64            `json:"cache_bytes"`
+	UpstreamBytes int64            `json:"upstream_bytes"`
+	Inflight      int64            `json:"inflight_downloads"`
+	TopHosts      TopLists         `json:"top_hosts"`
+	TopObjects    TopLists         `json:"top_objects"`
+	RecentErrors  []ErrorRecord    `json:"recent_errors"`
+	Egress        EgressHealth     `json:"egress"`
+}
+
+type TopLists struct {
+	ByHits  []TopItem `json:"by_hits"`
+	ByBytes []TopItem `json:"by_bytes"`
+}
+
+// TopItem counts cache traffic for one host or URL. Bytes are response bytes
+// sent to clients, from the cache or upstream.
+type TopItem struct {
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	Hits     int64  `json:"hits"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type ErrorRecord struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	URL     string    `json:"url"`
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+}
+
+// stats aggregates the in-memory counters behind Snapshot.
+type stats struct {
+	mu            sync.Mutex
+	startedAt     time.Time
+	requests      map[string]int64
+	cacheBytes    int64
+	upstreamBytes int64
+	hosts         *topCounter
+	objects       *topCounter
+	errors        []ErrorRecord
+	nextError     int
+}
+
+func newStats() *stats {
+	return &stats{
+		startedAt: time.Now(),
+		requests:  make(map[string]int64),
+		hosts:     newTopCounter(maxTrackedHosts),
+		objects:   newTopCounter(maxTrackedObjects),
+	}
+}
+
+func (s *stats) record(rr *responseRecorder, method, target, host string) {
+	target = redactURL(target)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[rr.outcome]++
+	switch rr.outcome {
+	case outcomeHit, outcomeStale:
+		s.cacheBytes += rr.bytes
+	case outcomeError:
+		s.addError(ErrorRecord{
+			Time:    time.Now(),
+			Method:  method,
+			URL:     target,
+			Status:  rr.status,
+			Message: rr.errMsg,
+		})
+		return
+	case outcomeDenied, outcomeLimited:
+		return
+	default:
+		s.upstreamBytes += rr.bytes
+	}
+
+	if rr.outcome != outcomeHit && rr.outcome != outcomeMiss {
+		return
+	}
+	hit := rr.outcome == outcomeHit
+	s.hosts.add(host, hit, rr.bytes)
+	s.objects.add(target, hit, rr.bytes)
+}
+
+// addError stores err in a ring buffer of the most recent errors.
+func (s *stats) addError(err ErrorRecord) {
+	if len(s.errors) < maxRecentErrors {
+		s.errors = append(s.errors, err)
+		return
+	}
+	s.errors[s.nextError] = err
+	s.nextError = (s.nextError + 1) % maxRecentErrors
+}
+
+func (s *stats) snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := make(map[string]int64, len(s.requests))
+	for k, v := range s.requests {
+		requests[k] = v
+	}
+
+	// Newest first.
+	errors := make([]ErrorRecord, 0, len(s.errors))
+	for i := 0; i < len(s.errors); i++ {
+		idx := (s.nextError - 1 - i + 2*len(s.errors)) % len(s.errors)
+		errors = append(errors, s.errors[idx])
+	}
+
+	return Snapshot{
+		StartedAt:     s.startedAt,
+		Requests:      requests,
+		CacheBytes:    s.cacheBytes,
+		UpstreamBytes: s.upstreamBytes,
+		TopHosts:      s.hosts.top(topN),
+		TopObjects:    s.objects.top(topN),
+		RecentErrors:  errors,
+	}
+}
+
+// topCounter counts traffic per key for at most max keys. When it is full, a
+// new key replaces the one with the fewest requests, so heavy hitters stay
+// while the long tail churns.
+type topCounter struct {
+	max   int
+	items map[string]*TopItem
+}
+
+func newTopCounter(max int) *topCounter {
+	return &topCounter{max: max, items: make(map[string]*TopItem)}
+}
+
+func (t *topCounter) add(key string, hit bool, bytes int64) {
+	if key == "" {
+		return
+	}
+	item, ok := t.items[key]
+	if !ok {
+		if len(t.items) >= t.max {
+			t.evict()
+		}
+		item = &TopItem{Key: key}
+		t.items[key] = item
+	}
+	item.Requests++
+	if hit {
+		item.Hits++
+	}
+	item.Bytes += bytes
+}
+
+func (t *topCounter) evict() {
+	var victim *TopItem
+	for _, item := range t.items {
+		if victim == nil || item.Requests < victim.Requests {
+			victim = item
+		}
+	}
+	if victim != nil {
+		delete(t.items, victim.Key)
+	}
+}
+
+func (t *topCounter) top(n int) TopLists {
+	items := make([]TopItem, 0, len(t.items))
+	for _, item := range t.items {
+		items = append(items, *item)
+	}
+
+	byHits := append([]TopItem(nil), items...)
+	sort.Slice(byHits, func(i, j int) bool {
+		if byHits[i].Hits != byHits[j].Hits {
+			return byHits[i].Hits > byHits[j].Hits
+		}
+		return byHits[i].Key < byHits[j].Key
+	})
+	byBytes := items
+	sort.Slice(byBytes, func(i, j int) bool {
+		if byBytes[i].Bytes != byBytes[j].Bytes {
+			return byBytes[i].Bytes > byBytes[j].Bytes
+		}
+		return byBytes[i].Key < byBytes[j].Key
+	})
+
+	if len(byHits) > n {
+		byHits = byHits[:n]
+		byBytes = byBytes[:n]
+	}
+	return TopLists{ByHits: byHits, ByBytes: byBytes}
+}
+
+// redactURL strips credentials from a URL before it is shown.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
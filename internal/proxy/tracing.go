@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+
+	"cascade/internal/tracing"
+)
+
+// clientTrace opens child spans of the upstream span in ctx for the TLS
+// handshake and for the wait between sending the request and receiving the
+// first response byte. Dialing is traced by the egress dialer.
+func clientTrace(ctx context.Context) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var handshake, wait *tracing.Span
+
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			tracing.SpanFromContext(ctx).Set("cascade.upstream.conn_reused", info.Reused)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			_, handshake = tracing.Start(ctx, "upstream.tls", tracing.KindInternal)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			handshake.Fail(err)
+			handshake.End()
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, wait = tracing.Start(ctx, "upstream.first_byte", tracing.KindInternal)
+			if info.Err != nil {
+				wait.Fail(info.Err)
+				wait.End()
+			}
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			wait.End()
+		},
+	}
+}
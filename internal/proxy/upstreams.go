@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"cascade/internal/config"
+	"cascade/internal/metrics"
+)
+
+var (
+	upstreamQueued = metrics.Default.NewGaugeVec(
+		"cascade_upstream_queued_requests",
+		"Requests waiting for a free connection slot to their origin.",
+		"host_group")
+	upstreamRejectedTotal = metrics.Default.NewCounterVec(
+		"cascade_upstream_rejected_total",
+		"Upstream requests failed without being sent, by reason: breaker_open or queue_timeout.",
+		"reason", "host_group")
+	breakersOpen = metrics.Default.NewGaugeVec(
+		"cascade_upstream_breakers_open",
+		"Origin hosts whose circuit breaker is open or half-open.",
+		"host_group")
+	breakerTransitionsTotal = metrics.Default.NewCounterVec(
+		"cascade_upstream_breaker_transitions_total",
+		"Circuit breaker state changes, by the state entered.",
+		"state", "host_group")
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// BreakerOpenError is returned for a request to a host whose circuit breaker
+// is open.
+type BreakerOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", e.Host)
+}
+
+// QueueTimeoutError is returned for a request that waited too long for a
+// connection slot to its host.
+type QueueTimeoutError struct {
+	Host  string
+	Limit int
+}
+
+func (e *QueueTimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for one of %d connection slots to %s", e.Limit, e.Host)
+}
+
+// upstreams tracks the connection slots and circuit breaker of each origin,
+// by host and port. An origin's state is dropped once it is idle and
+// healthy.
+type upstreams struct {
+	cfg   config.UpstreamsConfig
+	group func(host string) string
+
+	mu    sync.Mutex
+	hosts map[string]*upstream
+}
+
+type upstream struct {
+	host  string
+	group string
+	cfg   config.UpstreamConfig
+	slots chan struct{} // nil without a limit
+	refs  int           // guarded by upstreams.mu
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	until    time.Time
+	trial    bool
+	retired  bool
+}
+
+func newUpstreams(cfg config.UpstreamsConfig, group func(host string) string) *upstreams {
+	return &upstreams{cfg: cfg, group: group, hosts: make(map[string]*upstream)}
+}
+
+// retire takes u's breakers out of the metrics once a reload has replaced u.
+func (u *upstreams) retire() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, up := range u.hosts {
+		up.mu.Lock()
+		if up.state != breakerClosed {
+			breakersOpen.WithLabelValues(up.group).Dec()
+		}
+		up.retired = true
+		up.mu.Unlock()
+	}
+}
+
+func (u *upstreams) get(host string) *upstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	up, ok := u.hosts[host]
+	if !ok {
+		name := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			name = h
+		}
+		cfg := u.cfg.For(name)
+		up = &upstream{host: host, group: u.group(name), cfg: cfg, state: breakerClosed}
+		if cfg.MaxConnections > 0 {
+			up.slots = make(chan struct{}, cfg.MaxConnections)
+		}
+		u.hosts[host] = up
+	}
+	up.refs++
+	return up
+}
+
+func (u *upstreams) put(up *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	up.refs--
+	if up.refs == 0 && up.idle() {
+		delete(u.hosts, up.host)
+	}
+}
+
+// acquire waits for a connection slot to host, a host:port, and checks its
+// breaker. The
+// returned function must be called with the outcome once the response has
+// been read: err, the response status, or neither if the attempt says
+// nothing about the host's health.
+func (u *upstreams) acquire(ctx context.Context, host string) (func(status int, err error), error) {
+	up := u.get(host)
+	if err := up.allow(); err != nil {
+		u.put(up)
+		upstreamRejectedTotal.WithLabelValues("breaker_open", up.group).Inc()
+		return nil, err
+	}
+	if err := up.wait(ctx); err != nil {
+		up.done(0, nil)
+		u.put(up)
+		return nil, err
+	}
+	return func(status int, err error) {
+		if up.slots != nil {
+			<-up.slots
+		}
+		up.done(status, err)
+		u.put(up)
+	}, nil
+}
+
+// wait takes a connection slot, queueing for up to the queue timeout.
+func (up *upstream) wait(ctx context.Context) error {
+	if up.slots == nil {
+		return nil
+	}
+	select {
+	case up.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if up.cfg.QueueTimeout < 0 {
+		upstreamRejectedTotal.WithLabelValues("queue_timeout", up.group).Inc()
+		return &QueueTimeoutError{Host: up.host, Limit: cap(up.slots)}
+	}
+
+	queued := upstreamQueued.WithLabelValues(up.group)
+	queued.Inc()
+	defer queued.Dec()
+	t := time.NewTimer(up.cfg.QueueTimeout)
+	defer t.Stop()
+	select {
+	case up.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		upstreamRejectedTotal.WithLabelValues("queue_timeout", up.group).Inc()
+		return &QueueTimeoutError{Host: up.host, Limit: cap(up.slots)}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allow fails fast while the breaker is open. Once it has been open for
+// long enough, one trial request is let through.
+func (up *upstream) allow() error {
+	if up.cfg.Breaker.Failures < 0 {
+		return nil
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	switch up.state {
+	case breakerOpen:
+		if time.Now().Before(up.until) {
+			return &BreakerOpenError{Host: up.host, Until: up.until}
+		}
+		up.setState(breakerHalfOpen)
+		up.trial = true
+		logger.Info("circuit breaker half-open, sending a trial request", "host", up.host)
+	case breakerHalfOpen:
+		if up.trial {
+			return &BreakerOpenError{Host: up.host, Until: time.Now().Add(time.Second)}
+		}
+		up.trial = true
+	}
+	return nil
+}
+
+// done records the outcome of a request that allow let through.
+func (up *upstream) done(status int, err error) {
+	if up.cfg.Breaker.Failures < 0 {
+		return
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.state == breakerHalfOpen {
+		up.trial = false
+	}
+
+	switch {
+	case err != nil || status >= 500:
+		up.failures++
+		if up.state == breakerHalfOpen || (up.state == breakerClosed && up.failures >= up.cfg.Breaker.Failures) {
+			up.until = time.Now().Add(up.cfg.Breaker.OpenFor)
+			up.setState(breakerOpen)
+			logger.Warn("circuit breaker opened", "host", up.host, "failures", up.failures,
+				"open_for", up.cfg.Breaker.OpenFor.String(), "err", err, "status", status)
+		}
+	case status != 0:
+		up.failures = 0
+		if up.state != breakerClosed {
+			up.setState(breakerClosed)
+			logger.Info("circuit breaker closed", "host", up.host)
+		}
+	}
+}
+
+// setState moves the breaker to state; up.mu must be held.
+func (up *upstream) setState(state string) {
+	switch {
+	case up.retired:
+	case up.state == breakerClosed:
+		breakersOpen.WithLabelValues(up.group).Inc()
+	case state == breakerClosed:
+		breakersOpen.WithLabelValues(up.group).Dec()
+	}
+	up.state = state
+	breakerTransitionsTotal.WithLabelValues(state, up.group).Inc()
+}
+
+// idle reports whether the host's state carries nothing worth keeping.
+func (up *upstream) idle() bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.state == breakerClosed && up.failures == 0
+}
+
+// releaseBody calls release when the response body is closed, with the
+// status the response arrived with.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	status  int
+	release func(status int, err error)
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.release(b.status, nil) })
+	return err
+}
+
+func withRelease(resp *http.Response, release func(status int, err error)) {
+	resp.Body = &releaseBody{ReadCloser: resp.Body, status: resp.StatusCode, release: release}
+}
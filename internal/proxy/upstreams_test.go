@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cascade/internal/config"
+)
+
+func newTestUpstreams(cfg config.UpstreamConfig) *upstreams {
+	return newUpstreams(config.UpstreamsConfig{Default: cfg}, func(string) string { return otherHostGroup })
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	up := &upstream{
+		host:  "deb.debian.org:80",
+		group: otherHostGroup,
+		cfg:   config.UpstreamConfig{Breaker: config.BreakerConfig{Failures: 2, OpenFor: time.Hour}},
+		state: breakerClosed,
+	}
+	refused := errors.New("connection refused")
+
+	// Each step calls allow and, if it lets the request through, done.
+	steps := []struct {
+		name    string
+		expire  bool // let the open period run out before allow
+		allowed bool
+		status  int
+		err     error
+		state   string
+	}{
+		{"first failure", false, true, 0, refused, breakerClosed},
+		{"success resets the count", false, true, 200, nil, breakerClosed},
+		{"failure after reset", false, true, 503, nil, breakerClosed},
+		{"second failure in a row opens", false, true, 0, refused, breakerOpen},
+		{"open refuses", false, false, 0, nil, breakerOpen},
+		{"failed trial reopens", true, true, 500, nil, breakerOpen},
+		{"reopened refuses", false, false, 0, nil, breakerOpen},
+		{"successful trial closes", true, true, 304, nil, breakerClosed},
+		{"closed allows", false, true, 200, nil, breakerClosed},
+	}
+	for _, st := range steps {
+		if st.expire {
+			up.until = time.Now().Add(-time.Second)
+		}
+		err := up.allow()
+		var open *BreakerOpenError
+		if st.allowed != (err == nil) || (err != nil && !errors.As(err, &open)) {
+			t.Fatalf("%s: allow = %v, want allowed %v", st.name, err, st.allowed)
+		}
+		if err == nil && (st.status != 0 || st.err != nil) {
+			up.done(st.status, st.err)
+		}
+		if up.state != st.state {
+			t.Fatalf("%s: state = %s, want %s", st.name, up.state, st.state)
+		}
+	}
+}
+
+func TestBreakerHalfOpenAllowsOneTrial(t *testing.T) {
+	up := &upstream{
+		host:  "deb.debian.org:80",
+		group: otherHostGroup,
+		cfg:   config.UpstreamConfig{Breaker: config.BreakerConfig{Failures: 1, OpenFor: time.Hour}},
+		state: breakerClosed,
+	}
+	up.done(0, errors.New("timeout"))
+	up.until = time.Now().Add(-time.Second)
+
+	if err := up.allow(); err != nil {
+		t.Fatalf("trial refused: %v", err)
+	}
+	if err := up.allow(); err == nil {
+		t.Fatal("second request let through while the trial runs")
+	}
+	// A trial that says nothing about the host's health frees the slot for
+	// another one.
+	up.done(0, nil)
+	if up.state != breakerHalfOpen {
+		t.Fatalf("state = %s after an inconclusive trial, want %s", up.state, breakerHalfOpen)
+	}
+	if err := up.allow(); err != nil {
+		t.Fatalf("next trial refused: %v", err)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	up := &upstream{
+		host:  "deb.debian.org:80",
+		group: otherHostGroup,
+		cfg:   config.UpstreamConfig{Breaker: config.BreakerConfig{Failures: -1, OpenFor: time.Hour}},
+		state: breakerClosed,
+	}
+	for i := 0; i < 10; i++ {
+		if err := up.allow(); err != nil {
+			t.Fatalf("allow = %v with the breaker disabled", err)
+		}
+		up.done(502, nil)
+	}
+	if up.state != breakerClosed {
+		t.Errorf("state = %s with the breaker disabled", up.state)
+	}
+}
+
+func TestSlotQueueing(t *testing.T) {
+	u := newTestUpstreams(config.UpstreamConfig{
+		MaxConnections: 1,
+		QueueTimeout:   20 * time.Millisecond,
+		Breaker:        config.BreakerConfig{Failures: -1},
+	})
+	const host = "deb.debian.org:80"
+	ctx := context.Background()
+
+	release, err := u.acquire(ctx, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only slot is taken: a second request queues, then times out.
+	start := time.Now()
+	_, err = u.acquire(ctx, host)
+	var timeout *QueueTimeoutError
+	if !errors.As(err, &timeout) || timeout.Limit != 1 || timeout.Host != host {
+		t.Fatalf("acquire with no free slot = %v, want a QueueTimeoutError", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("queue timeout after %v, want 20ms", elapsed)
+	}
+
+	// A queued request gets the slot as soon as it is released.
+	got := make(chan error, 1)
+	go func() {
+		r, err := u.acquire(ctx, host)
+		if err == nil {
+			r(200, nil)
+		}
+		got <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	release(200, nil)
+	if err := <-got; err != nil {
+		t.Errorf("queued acquire = %v after the slot was released", err)
+	}
+
+	// Other hosts have slots of their own.
+	release, err = u.acquire(ctx, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := u.acquire(ctx, "ftp.debian.org:80")
+	if err != nil {
+		t.Errorf("acquire for another host = %v", err)
+	} else {
+		other(200, nil)
+	}
+
+	// Cancelling the request stops it queueing.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := u.acquire(cctx, host); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire with a cancelled context = %v, want context.Canceled", err)
+	}
+	release(200, nil)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.hosts) != 0 {
+		t.Errorf("%d idle, healthy hosts kept", len(u.hosts))
+	}
+}
+
+func TestSlotQueueTimeoutNegative(t *testing.T) {
+	u := newTestUpstreams(config.UpstreamConfig{MaxConnections: 1, QueueTimeout: -1, Breaker: config.BreakerConfig{Failures: -1}})
+	release, err := u.acquire(context.Background(), "deb.debian.org:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release(200, nil)
+
+	start := time.Now()
+	_, err = u.acquire(context.Background(), "deb.debian.org:80")
+	var timeout *QueueTimeoutError
+	if !errors.As(err, &timeout) || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("acquire = %v after %v, want an immediate QueueTimeoutError", err, time.Since(start))
+	}
+}
+
+func TestUnlimitedSlots(t *testing.T) {
+	u := newTestUpstreams(config.UpstreamConfig{MaxConnections: -1, Breaker: config.BreakerConfig{Failures: -1}})
+	var releases []func(int, error)
+	for i := 0; i < 500; i++ {
+		release, err := u.acquire(context.Background(), "deb.debian.org:80")
+		if err != nil {
+			t.Fatalf("acquire %d = %v without a limit", i, err)
+		}
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release(200, nil)
+	}
+}
+
+func TestAcquireRefusesWhileOpen(t *testing.T) {
+	u := newTestUpstreams(config.UpstreamConfig{
+		MaxConnections: 2,
+		QueueTimeout:   time.Second,
+		Breaker:        config.BreakerConfig{Failures: 1, OpenFor: time.Hour},
+	})
+	release, err := u.acquire(context.Background(), "deb.debian.org:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(0, errors.New("connection reset"))
+
+	_, err = u.acquire(context.Background(), "deb.debian.org:80")
+	var open *BreakerOpenError
+	if !errors.As(err, &open) || open.Host != "deb.debian.org:80" {
+		t.Errorf("acquire with the breaker open = %v, want a BreakerOpenError", err)
+	}
+
+	// The open breaker is kept even though no request holds the host.
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.hosts) != 1 {
+		t.Errorf("%d hosts kept, want the one with the open breaker", len(u.hosts))
+	}
+}
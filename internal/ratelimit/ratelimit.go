@@ -0,0 +1,191 @@
+// Package ratelimit implements token buckets for limiting request rates and
+// bandwidth.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket that fills at rate tokens per second up to burst.
+type Bucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket, or nil if rate is not positive; a nil
+// *Bucket never limits.
+func NewBucket(rate float64, burst int) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// fill adds the tokens accrued since the last call; b.mu must be held.
+func (b *Bucket) fill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Allow takes a token if one is available. Otherwise it returns false and
+// how long until one will be.
+func (b *Bucket) Allow() (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, seconds((1 - b.tokens) / b.rate)
+}
+
+// WaitN takes n tokens, waiting until they have accrued. n may exceed the
+// burst; the bucket then goes into debt that later callers wait out.
+func (b *Bucket) WaitN(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	b.fill(time.Now())
+	b.tokens -= float64(n)
+	wait := seconds(-b.tokens / b.rate)
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// full reports whether the bucket has refilled completely, so it can be
+// forgotten and recreated without changing what it allows.
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fill(now)
+	return b.tokens >= b.burst
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// sweepInterval is how often a Keyed drops the buckets of idle keys.
+const sweepInterval = time.Minute
+
+// Keyed holds a bucket per key, such as a client address.
+type Keyed struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewKeyed returns nil if rate is not positive; a nil *Keyed hands out nil
+// buckets, which never limit.
+func NewKeyed(rate float64, burst int) *Keyed {
+	if rate <= 0 {
+		return nil
+	}
+	return &Keyed{rate: rate, burst: burst, buckets: make(map[string]*Bucket), lastSweep: time.Now()}
+}
+
+// Get returns the bucket for key, creating it if needed.
+func (k *Keyed) Get(key string) *Bucket {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(k.lastSweep) >= sweepInterval {
+		for key, b := range k.buckets {
+			if b.full(now) {
+				delete(k.buckets, key)
+			}
+		}
+		k.lastSweep = now
+	}
+
+	b, ok := k.buckets[key]
+	if !ok {
+		b = NewBucket(k.rate, k.burst)
+		k.buckets[key] = b
+	}
+	return b
+}
+
+// maxChunk bounds how much a Writer passes on at once, so throttled output
+// flows steadily rather than in bursts.
+const maxChunk = 32 << 10
+
+// Writer returns a writer that takes a token from every bucket for each byte
+// before writing it to w. Nil buckets are skipped; if none are left, w is
+// returned as is. Waiting stops with an error when ctx is done.
+func Writer(ctx context.Context, w io.Writer, buckets ...*Bucket) io.Writer {
+	tw := &writer{ctx: ctx, w: w, chunk: maxChunk}
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		tw.buckets = append(tw.buckets, b)
+		if burst := int(b.burst); burst < tw.chunk {
+			tw.chunk = burst
+		}
+	}
+	if len(tw.buckets) == 0 {
+		return w
+	}
+	return tw
+}
+
+type writer struct {
+	ctx     context.Context
+	w       io.Writer
+	buckets []*Bucket
+	chunk   int
+}
+
+func (tw *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), tw.chunk)
+		for _, b := range tw.buckets {
+			if err := b.WaitN(tw.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := tw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
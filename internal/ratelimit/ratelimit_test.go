@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rewind makes the bucket's last fill d earlier, as if d had passed.
+func rewind(b *Bucket, d time.Duration) {
+	b.mu.Lock()
+	b.last = b.last.Add(-d)
+	b.mu.Unlock()
+}
+
+func TestBucketRefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		take    int           // tokens taken before time passes
+		elapsed time.Duration // time passed afterwards
+		allowed int           // tokens Allow then hands out
+	}{
+		{"full bucket", 10, 3, 0, 0, 3},
+		{"empty bucket", 10, 3, 3, 0, 0},
+		{"partial refill", 10, 3, 3, 250 * time.Millisecond, 2},
+		{"refill capped at burst", 10, 3, 3, time.Hour, 3},
+		{"burst below one", 10, 0, 1, 50 * time.Millisecond, 0},
+		{"slow rate", 0.5, 1, 1, 2 * time.Second, 1},
+	}
+	for _, tt := range tests {
+		b := NewBucket(tt.rate, tt.burst)
+		for i := 0; i < tt.take; i++ {
+			if ok, _ := b.Allow(); !ok {
+				t.Fatalf("%s: token %d of a full bucket refused", tt.name, i)
+			}
+		}
+		rewind(b, tt.elapsed)
+		allowed := 0
+		for {
+			ok, wait := b.Allow()
+			if !ok {
+				if wait <= 0 || wait > time.Duration(float64(time.Second)/tt.rate) {
+					t.Errorf("%s: refused with wait %v, want up to one token's time", tt.name, wait)
+				}
+				break
+			}
+			allowed++
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: allowed %d, want %d", tt.name, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestNilBucketNeverLimits(t *testing.T) {
+	b := NewBucket(0, 10)
+	if b != nil {
+		t.Fatal("NewBucket with a rate of 0 returned a bucket")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := b.Allow(); !ok {
+			t.Fatal("nil bucket refused a token")
+		}
+	}
+	if err := b.WaitN(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil bucket WaitN = %v", err)
+	}
+	if NewKeyed(-1, 10).Get("client") != nil {
+		t.Error("NewKeyed with a negative rate handed out a bucket")
+	}
+}
+
+func TestWaitNDebt(t *testing.T) {
+	b := NewBucket(100, 10)
+	start := time.Now()
+	if err := b.WaitN(context.Background(), 12); err != nil {
+		t.Fatal(err)
+	}
+	// 10 tokens were there; 2 more take 20ms.
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("WaitN(12) returned after %v, want about 20ms", elapsed)
+	}
+
+	// Taking more than the bucket holds leaves it in debt.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.WaitN(ctx, 50); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitN in debt with a cancelled context = %v, want context.Canceled", err)
+	}
+	if ok, wait := b.Allow(); ok || wait < 400*time.Millisecond {
+		t.Errorf("Allow after going 50 tokens into debt = %v, %v; want a wait of about 500ms", ok, wait)
+	}
+}
+
+func TestKeyedSweepsFullBuckets(t *testing.T) {
+	k := NewKeyed(10, 2)
+	busy, idle := k.Get("busy"), k.Get("idle")
+	if busy == idle {
+		t.Fatal("two keys share a bucket")
+	}
+	busy.Allow()
+	if k.Get("busy") != busy {
+		t.Fatal("Get returned a new bucket for a known key")
+	}
+
+	k.mu.Lock()
+	k.lastSweep = k.lastSweep.Add(-sweepInterval)
+	k.mu.Unlock()
+	k.Get("other")
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.buckets["idle"]; ok {
+		t.Error("full bucket kept after a sweep")
+	}
+	if k.buckets["busy"] != busy {
+		t.Error("bucket with tokens taken dropped by a sweep")
+	}
+}
+
+func TestWriterChunksByBurst(t *testing.T) {
+	var out bytes.Buffer
+	b := NewBucket(1e6, 4)
+	w := Writer(context.Background(), &out, nil, b)
+	if tw, ok := w.(*writer); !ok || tw.chunk != 4 || len(tw.buckets) != 1 {
+		t.Fatalf("Writer = %#v, want chunks of the burst and one bucket", w)
+	}
+	n, err := w.Write([]byte("hello, world"))
+	if err != nil || n != 12 || out.String() != "hello, world" {
+		t.Errorf("Write = %d, %v, wrote %q", n, err, out.String())
+	}
+
+	if Writer(context.Background(), &out, nil, nil) != &out {
+		t.Error("Writer without buckets did not return the writer as is")
+	}
+}
@@ -0,0 +1,259 @@
+// Package tracing records spans for requests moving through the proxy, cache
+// and upstream, propagates W3C trace context and exports finished spans to an
+// OpenTelemetry collector over OTLP/HTTP. Until Setup is called every
+// function is a cheap no-op and Start returns a nil *Span, whose methods are
+// safe to call.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent renders the W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields; later versions may append more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+type provider struct {
+	service  string
+	ratio    float64
+	exporter *exporter
+}
+
+var current atomic.Pointer[provider]
+
+// Setup starts exporting spans to endpoint, an OTLP/HTTP traces URL such as
+// http://localhost:4318/v1/traces. Traces without a sampled parent are
+// sampled with probability sampleRatio. The returned function flushes
+// pending spans and stops the exporter.
+func Setup(endpoint string, headers map[string]string, serviceName string, sampleRatio float64) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("tracing endpoint is required")
+	}
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio must be between 0 and 1, got %v", sampleRatio)
+	}
+
+	p := &provider{
+		service:  serviceName,
+		ratio:    sampleRatio,
+		exporter: newExporter(endpoint, headers, serviceName),
+	}
+	current.Store(p)
+
+	return func(ctx context.Context) error {
+		current.CompareAndSwap(p, nil)
+		return p.exporter.shutdown(ctx)
+	}, nil
+}
+
+// sample decides from the trace ID alone, so every span of a trace started
+// here gets the same decision.
+func (p *provider) sample(id TraceID) bool {
+	if p.ratio >= 1 {
+		return true
+	}
+	bound := uint64(p.ratio * (1 << 63))
+	return binary.BigEndian.Uint64(id[8:])>>1 < bound
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// Extract returns a context carrying the remote parent described by the
+// traceparent header in h, if there is a valid one.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := ParseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// Inject sets the traceparent header for the span in ctx, so the next hop
+// joins the trace.
+func Inject(ctx context.Context, h http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		h.Set("traceparent", span.sc.Traceparent())
+	}
+}
+
+// SpanFromContext returns the active span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+func parentFrom(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.sc
+	}
+	sc, _ := ctx.Value(remoteKey).(SpanContext)
+	return sc
+}
+
+// Start begins a span as a child of the span, or remote parent, in ctx and
+// returns a context carrying the new span.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	p := current.Load()
+	if p == nil {
+		return ctx, nil
+	}
+
+	parent := parentFrom(ctx)
+	span := &Span{
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		parent:   parent.SpanID,
+		provider: p,
+	}
+	if parent.IsValid() {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = p.sample(span.sc.TraceID)
+	}
+	rand.Read(span.sc.SpanID[:])
+
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// Span is one timed operation in a trace. A nil *Span ignores every call.
+type Span struct {
+	mu       sync.Mutex
+	name     string
+	kind     Kind
+	sc       SpanContext
+	parent   SpanID
+	start    time.Time
+	end      time.Time
+	attrs    []attribute
+	errMsg   string
+	failed   bool
+	ended    bool
+	provider *provider
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Context returns the span's identity.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// Set records an attribute. Values should be strings, integers, floats,
+// booleans or time.Durations; anything else is recorded as its string form.
+func (s *Span) Set(key string, value any) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// Fail marks the span as failed with err. A nil err is ignored.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.provider.exporter.enqueue(s)
+	}
+}
@@ -0,0 +1,244 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector that keeps every span
+// it receives.
+type collector struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []otlpRequest
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			t.Errorf("collector got %s %s", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		if got := r.Header.Get("X-Api-Key"); got != "secret" {
+			t.Errorf("X-Api-Key = %q, want the configured header", got)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding export: %v", err)
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, req)
+		c.mu.Unlock()
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// setup starts tracing against c and returns a function that flushes the
+// exporter and returns the spans c received, by name.
+func (c *collector) setup(t *testing.T, ratio float64) func() map[string]otlpSpan {
+	shutdown, err := Setup(c.URL+"/v1/traces", map[string]string{"X-Api-Key": "secret"}, "cascade-test", ratio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() map[string]otlpSpan {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			t.Fatalf("shutdown: %v", err)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		spans := make(map[string]otlpSpan)
+		for _, req := range c.requests {
+			for _, rs := range req.ResourceSpans {
+				if len(rs.Resource.Attributes) != 1 || rs.Resource.Attributes[0].Key != "service.name" ||
+					*rs.Resource.Attributes[0].Value.StringValue != "cascade-test" {
+					t.Errorf("resource attributes = %+v, want service.name", rs.Resource.Attributes)
+				}
+				for _, ss := range rs.ScopeSpans {
+					for _, s := range ss.Spans {
+						spans[s.Name] = s
+					}
+				}
+			}
+		}
+		return spans
+	}
+}
+
+func TestExportLinksSpansToRemoteParent(t *testing.T) {
+	c := newCollector(t)
+	flush := c.setup(t, 0)
+
+	const (
+		remoteTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		remoteSpan  = "00f067aa0ba902b7"
+	)
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-"+remoteTrace+"-"+remoteSpan+"-01")
+
+	// A sampled remote parent overrides the sample ratio of 0.
+	ctx, server := Start(Extract(context.Background(), incoming), "GET", KindServer)
+	server.Set("http.response.status_code", 200)
+	ctx, client := Start(ctx, "upstream GET", KindClient)
+	client.Set("url.full", "http://deb.debian.org/debian/dists/bookworm/InRelease")
+	client.Fail(errors.New("connection refused"))
+
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	sc := client.Context()
+	if want := "00-" + remoteTrace + "-" + hex.EncodeToString(sc.SpanID[:]) + "-01"; outgoing.Get("traceparent") != want {
+		t.Errorf("injected traceparent = %q, want %q", outgoing.Get("traceparent"), want)
+	}
+
+	client.End()
+	server.End()
+	server.End() // ending twice exports once
+	spans := flush()
+
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2: %+v", len(spans), spans)
+	}
+	s, cl := spans["GET"], spans["upstream GET"]
+	if s.TraceID != remoteTrace || cl.TraceID != remoteTrace {
+		t.Errorf("trace IDs = %s, %s, want %s", s.TraceID, cl.TraceID, remoteTrace)
+	}
+	if s.ParentSpanID != remoteSpan {
+		t.Errorf("server span parent = %q, want the remote span %s", s.ParentSpanID, remoteSpan)
+	}
+	if cl.ParentSpanID != s.SpanID {
+		t.Errorf("client span parent = %q, want the server span %s", cl.ParentSpanID, s.SpanID)
+	}
+	if len(s.SpanID) != 16 || s.SpanID == remoteSpan || s.SpanID == cl.SpanID {
+		t.Errorf("span IDs %q and %q are not fresh 8-byte IDs", s.SpanID, cl.SpanID)
+	}
+	if s.Kind != KindServer || cl.Kind != KindClient {
+		t.Errorf("kinds = %d, %d, want %d, %d", s.Kind, cl.Kind, KindServer, KindClient)
+	}
+	if s.Status != nil {
+		t.Errorf("server span status = %+v, want none", s.Status)
+	}
+	if cl.Status == nil || cl.Status.Code != statusError || cl.Status.Message != "connection refused" {
+		t.Errorf("client span status = %+v, want an error", cl.Status)
+	}
+	if len(s.Attributes) != 1 || s.Attributes[0].Key != "http.response.status_code" || *s.Attributes[0].Value.IntValue != "200" {
+		t.Errorf("server span attributes = %+v", s.Attributes)
+	}
+	if s.StartTimeUnixNano == "" || s.EndTimeUnixNano < s.StartTimeUnixNano {
+		t.Errorf("server span times = %s..%s", s.StartTimeUnixNano, s.EndTimeUnixNano)
+	}
+}
+
+func TestSamplingDecision(t *testing.T) {
+	c := newCollector(t)
+	flush := c.setup(t, 0)
+
+	_, root := Start(context.Background(), "root", KindServer)
+	if root.Context().Sampled {
+		t.Error("root span sampled with a ratio of 0")
+	}
+
+	unsampled := http.Header{}
+	unsampled.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, child := Start(Extract(context.Background(), unsampled), "unsampled parent", KindServer)
+	if child.Context().Sampled {
+		t.Error("child of an unsampled remote parent is sampled")
+	}
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if got := outgoing.Get("traceparent"); len(got) != 55 || got[53:] != "00" {
+		t.Errorf("injected traceparent = %q, want the unsampled flag", got)
+	}
+
+	root.End()
+	child.End()
+	if spans := flush(); len(spans) != 0 {
+		t.Errorf("exported unsampled spans: %+v", spans)
+	}
+
+	flush = c.setup(t, 1)
+	_, root = Start(context.Background(), "root", KindServer)
+	if !root.Context().Sampled {
+		t.Error("root span not sampled with a ratio of 1")
+	}
+	root.End()
+	if spans := flush(); len(spans) != 1 {
+		t.Errorf("exported %d spans, want the sampled root", len(spans))
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	p := &provider{ratio: 0.25}
+	rng := rand.New(rand.NewSource(1))
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		var id TraceID
+		rng.Read(id[:])
+		if p.sample(id) {
+			sampled++
+		}
+	}
+	if sampled < 2200 || sampled > 2800 {
+		t.Errorf("sampled %d of 10000 trace IDs with a ratio of 0.25", sampled)
+	}
+}
+
+func TestNoopWithoutSetup(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop", KindInternal)
+	if span != nil {
+		t.Fatal("Start returned a span without Setup")
+	}
+	span.Set("key", "value")
+	span.Fail(errors.New("ignored"))
+	span.End()
+
+	h := http.Header{}
+	Inject(ctx, h)
+	if h.Get("traceparent") != "" {
+		t.Errorf("injected %q without a span", h.Get("traceparent"))
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		in      string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03 ", true, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		sc, ok := ParseTraceparent(tt.in)
+		if ok != tt.ok || (ok && sc.Sampled != tt.sampled) {
+			t.Errorf("ParseTraceparent(%q) = sampled %v, ok %v; want %v, %v", tt.in, sc.Sampled, ok, tt.sampled, tt.ok)
+		}
+		if in := strings.TrimSpace(tt.in); ok && sc.Traceparent()[3:52] != in[3:52] {
+			t.Errorf("ParseTraceparent(%q) round-trips to %q", tt.in, sc.Traceparent())
+		}
+	}
+}